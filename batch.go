@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// batchSizer decides how many records go into the next batch. With adaptive
+// sizing off it always returns the initial size. With it on it behaves like
+// AIMD congestion control: the size grows by a fixed step after every batch
+// that is neither rejected nor noticeably slower per document than the best
+// batch seen so far, and is halved as soon as one is.
+type batchSizer struct {
+	mu       sync.Mutex
+	size     int
+	min, max int
+	step     int
+	adaptive bool
+
+	// best is the lowest per-document latency observed so far.
+	best time.Duration
+}
+
+func newBatchSizer(size, min, max int, adaptive bool) *batchSizer {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	step := size / 10
+	if step < 1 {
+		step = 1
+	}
+	s := &batchSizer{min: min, max: max, step: step, adaptive: adaptive}
+	s.size = s.clamp(size)
+	return s
+}
+
+func (s *batchSizer) clamp(n int) int {
+	if !s.adaptive {
+		return n
+	}
+	if n < s.min {
+		return s.min
+	}
+	if n > s.max {
+		return s.max
+	}
+	return n
+}
+
+// Size returns the size to use for the next batch.
+func (s *batchSizer) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Observe feeds the outcome of a finished batch back into the controller.
+func (s *batchSizer) Observe(r batchResult) {
+	if !s.adaptive {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	docs := r.Indexed + r.Failed
+	if docs == 0 {
+		return
+	}
+	perDoc := r.Took / time.Duration(docs)
+	if s.best == 0 || perDoc < s.best {
+		s.best = perDoc
+	}
+
+	old := s.size
+	if r.Rejected > 0 || perDoc > 2*s.best {
+		s.size = s.clamp(s.size / 2)
+	} else {
+		s.size = s.clamp(s.size + s.step)
+	}
+	if s.size != old {
+		log.Printf("Batch size %d -> %d", old, s.size)
+	}
+}
+
+// batcher groups a stream of datapoints into batches. A batch is sent as soon
+// as it holds Sizer.Size() records or, with MaxBytes set, as soon as adding
+// the next record would take its encoded size past MaxBytes, whichever comes
+// first. A single record larger than MaxBytes is sent in a batch of its own.
+// When FlushInterval is positive a partial batch is also sent once that long
+// has passed since the previous flush, bounding how long a slow producer can
+// leave records waiting.
+type batcher struct {
+	Sizer         *batchSizer
+	MaxBytes      int
+	FlushInterval time.Duration
+
+	// SizeOf returns the number of bytes d adds to a bulk request body. It is
+	// only consulted when MaxBytes is set.
+	SizeOf func(d datapoint) int
+
+	// LogEvery, if above 1, limits logging to every LogEvery-th batch.
+	LogEvery int
+}
+
+// logBatch reports whether batch id is logged when only every n-th batch is.
+func logBatch(id, n int) bool {
+	return n <= 1 || id%n == 0
+}
+
+// run reads points from in and sends batches to q, closing q once in is
+// closed and every point has been queued, or as soon as ctx is done.
+func (b *batcher) run(ctx context.Context, in <-chan datapoint, q chan<- batch) {
+	defer close(q)
+
+	var tick <-chan time.Time
+	var timer *time.Timer
+	if b.FlushInterval > 0 {
+		timer = time.NewTimer(b.FlushInterval)
+		defer timer.Stop()
+		tick = timer.C
+	}
+
+	id := 1
+	var payload []datapoint
+	var size int
+	flush := func() {
+		if len(payload) > 0 {
+			if logBatch(id, b.LogEvery) {
+				log.Printf("Sending batch %d to queue", id)
+			}
+			select {
+			case q <- batch{ID: id, Payload: payload}:
+			case <-ctx.Done():
+			}
+			id++
+			payload = nil
+			size = 0
+		}
+		if timer != nil {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(b.FlushInterval)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p, ok := <-in:
+			if !ok {
+				flush()
+				return
+			}
+			if b.MaxBytes > 0 {
+				n := b.SizeOf(p)
+				if len(payload) > 0 && size+n > b.MaxBytes {
+					flush()
+				}
+				size += n
+			}
+			payload = append(payload, p)
+			if len(payload) >= b.Sizer.Size() || (b.MaxBytes > 0 && size >= b.MaxBytes) {
+				flush()
+			}
+		case <-tick:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// loadWith sends points through a batcher sized by sizer and u, feeding each
+// result back into sizer as the loader does.
+func loadWith(u *Uploader, sizer *batchSizer, points []datapoint) *summary {
+	ctx := context.Background()
+	in := make(chan datapoint)
+	go func() {
+		defer close(in)
+		for _, p := range points {
+			in <- p
+		}
+	}()
+	q := make(chan batch)
+	go (&batcher{Sizer: sizer}).run(ctx, in, q)
+
+	s := newSummary()
+	for r := range u.Run(ctx, q) {
+		sizer.Observe(r)
+		s.add(r)
+	}
+	return s
+}
+
+// BenchmarkBatchSize compares a static batch size with the adaptive one
+// against a cluster whose requests cost a fixed overhead plus a little per
+// document, and which rejects requests of more than 600 documents.
+func BenchmarkBatchSize(b *testing.B) {
+	points := testPoints(4000)
+	es := &fakeES{
+		Latency: func(docs int) time.Duration { return 2*time.Millisecond + time.Duration(docs)*5*time.Microsecond },
+		MaxDocs: 600,
+	}
+	for _, bc := range []struct {
+		name     string
+		adaptive bool
+	}{
+		{"static", false},
+		{"adaptive", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var requests int
+			for i := 0; i < b.N; i++ {
+				before := es.Requests()
+				u := &Uploader{Client: es, Workers: 1, Index: "covid"}
+				s := loadWith(u, newBatchSizer(50, 10, 1000, bc.adaptive), points)
+				if s.Indexed+s.Failed != len(points) {
+					b.Fatalf("indexed %d and failed %d of %d", s.Indexed, s.Failed, len(points))
+				}
+				requests += es.Requests() - before
+			}
+			b.ReportMetric(float64(requests)/float64(b.N), "requests/op")
+		})
+	}
+}
+
+func TestBatcherFlushesSlowProducer(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := make(chan datapoint)
+	q := make(chan batch)
+	b := &batcher{Sizer: newBatchSizer(100, 1, 100, false), FlushInterval: interval}
+	go b.run(ctx, in, q)
+
+	points := testPoints(5)
+	// A producer that sends a few records and then stalls, as a slow feed
+	// does, must not leave them waiting for a full batch.
+	for _, n := range []int{3, 2} {
+		start := time.Now()
+		for _, p := range points[:n] {
+			in <- p
+		}
+		points = points[n:]
+		select {
+		case got := <-q:
+			if len(got.Payload) != n {
+				t.Errorf("flushed %d records, want %d", len(got.Payload), n)
+			}
+			if waited := time.Since(start); waited > 4*interval {
+				t.Errorf("partial batch flushed after %s, want within about %s", waited, interval)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("partial batch of %d not flushed within a second", n)
+		}
+	}
+
+	close(in)
+	if _, ok := <-q; ok {
+		t.Error("batch sent after the input closed empty")
+	}
+}
+
+func TestBatcherCountAndByteTriggers(t *testing.T) {
+	sizes := map[string]int{"tiny": 10, "huge": 600, "giant": 1500}
+	b := &batcher{
+		Sizer:    newBatchSizer(3, 1, 3, false),
+		MaxBytes: 1000,
+		SizeOf:   func(d datapoint) int { return sizes[d.Province] },
+	}
+	var points []datapoint
+	for _, kind := range []string{"tiny", "tiny", "tiny", "huge", "huge", "tiny", "tiny", "giant", "tiny"} {
+		points = append(points, datapoint{Province: kind})
+	}
+	in := make(chan datapoint)
+	go func() {
+		defer close(in)
+		for _, p := range points {
+			in <- p
+		}
+	}()
+	q := make(chan batch)
+	go b.run(context.Background(), in, q)
+
+	want := [][]string{
+		{"tiny", "tiny", "tiny"}, // count
+		{"huge"},                 // the next huge one would pass MaxBytes
+		{"huge", "tiny", "tiny"}, // count, while under MaxBytes
+		{"giant"},                // larger than MaxBytes on its own
+		{"tiny"},                 // the tail at end of input
+	}
+	var got [][]string
+	for bt := range q {
+		got = append(got, provinces(bt.Payload))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("batches = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/opensearch-project/opensearch-go"
+)
+
+// newClient returns a client for -backend talking to the -es-url addresses,
+// with a transport of its own, so clients created for different workers
+// never share a connection pool.
+//
+// OpenSearch forked from Elasticsearch 7.10 and its index, bulk, alias and
+// mapping APIs, which are all this tool uses, behave the same, so the esapi
+// requests work against either client. Beyond those the two differ:
+// OpenSearch has no Elasticsearch API keys, and its data streams and
+// composable index templates follow the 7.10 API, without the lifecycle and
+// template options Elasticsearch added later.
+func newClient() (bulkDoer, error) {
+	t, err := newTransport()
+	if err != nil {
+		return nil, err
+	}
+	password, err := secret(*esPassword, *esPasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	apiKey, err := secret(*esAPIKey, *esAPIKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var rt http.RoundTripper = t
+	if *traceHTTP {
+		rt = &tracingTransport{Next: t}
+	}
+	switch *backend {
+	case "es":
+	case "opensearch":
+		if apiKey != "" {
+			return nil, errors.New("-es-api-key is not supported with -backend opensearch")
+		}
+		return opensearch.NewClient(opensearch.Config{
+			Addresses: splitList(*esURL),
+			Username:  *esUsername,
+			Password:  password,
+			Transport: rt,
+
+			DisableRetry: *streamBulk,
+		})
+	default:
+		return nil, fmt.Errorf("unknown -backend %q, expected es or opensearch", *backend)
+	}
+	return elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: splitList(*esURL),
+		Username:  *esUsername,
+		Password:  password,
+		APIKey:    apiKey,
+		Transport: rt,
+
+		// Retries replay the request body, so the transport buffers it
+		// whole; -stream-bulk only saves memory without them.
+		DisableRetry: *streamBulk,
+	})
+}
+
+// secret returns the contents of file, without trailing whitespace, if file
+// is set and inline otherwise. Reading secrets from files, such as mounted
+// Kubernetes secrets, keeps them out of process listings.
+func secret(inline, file string) (string, error) {
+	if file == "" {
+		return inline, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), " \t\r\n"), nil
+}
+
+// newTransport returns a copy of the default transport, presenting the
+// -es-client-cert certificate if one is given.
+func newTransport() (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if (*esClientCert == "") != (*esClientKey == "") {
+		return nil, errors.New("-es-client-cert and -es-client-key must be given together")
+	}
+	if *esClientCert == "" {
+		return t, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(*esClientCert, *esClientKey)
+	if err != nil {
+		return nil, err
+	}
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	return t, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeClientCert writes a self-signed certificate and its key to PEM files
+// in dir and returns their paths.
+func writeClientCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "covid"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "client.crt")
+	keyFile = filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestNewTransportClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "covid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeClientCert(t, dir)
+
+	defer func(cert, key string) { *esClientCert, *esClientKey = cert, key }(*esClientCert, *esClientKey)
+	*esClientCert, *esClientKey = certFile, keyFile
+	tr, err := newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.TLSClientConfig == nil || len(tr.TLSClientConfig.Certificates) != 1 {
+		t.Fatalf("TLS config = %+v, want one client certificate", tr.TLSClientConfig)
+	}
+	if def := http.DefaultTransport.(*http.Transport); def.TLSClientConfig != nil && len(def.TLSClientConfig.Certificates) > 0 {
+		t.Error("the client certificate leaked into the default transport")
+	}
+
+	for _, tc := range []struct{ cert, key string }{
+		{certFile, ""},
+		{"", keyFile},
+	} {
+		*esClientCert, *esClientKey = tc.cert, tc.key
+		if _, err := newTransport(); err == nil {
+			t.Errorf("cert %q, key %q: no error, want one for an incomplete pair", tc.cert, tc.key)
+		}
+	}
+}
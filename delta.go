@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// seriesKey identifies the location and status a cumulative case count
+// belongs to.
+func seriesKey(d datapoint) string {
+	return d.CountryCode + "|" + d.Province + "|" + d.City + "|" + d.CityCode + "|" + d.Status
+}
+
+// computeCasesDelta sorts points by series then timestamp and sets CasesDelta
+// on each to the change in Cases since the previous record of its series. The
+// first record of a series gets its full count. A count that goes down, e.g.
+// after the source corrects or resets a series, or a series that starts out
+// negative is clamped to a delta of zero and counted in the returned number of
+// resets.
+func computeCasesDelta(points []datapoint) (resets int) {
+	sort.SliceStable(points, func(i, j int) bool {
+		ki, kj := seriesKey(points[i]), seriesKey(points[j])
+		if ki != kj {
+			return ki < kj
+		}
+		return points[i].Ts.Before(points[j].Ts)
+	})
+
+	for i := range points {
+		delta := points[i].Cases
+		if i > 0 && seriesKey(points[i-1]) == seriesKey(points[i]) {
+			delta = points[i].Cases - points[i-1].Cases
+			if delta < 0 {
+				if resets < 10 {
+					log.Printf("Warning: cases went from %d to %d for %s on %s, using a delta of 0",
+						points[i-1].Cases, points[i].Cases, seriesKey(points[i]), points[i].Ts.Format("2006-01-02"))
+				}
+				resets++
+				delta = 0
+			}
+		} else if delta < 0 {
+			if resets < 10 {
+				log.Printf("Warning: series %s starts at %d cases on %s, using a delta of 0",
+					seriesKey(points[i]), points[i].Cases, points[i].Ts.Format("2006-01-02"))
+			}
+			resets++
+			delta = 0
+		}
+		d := delta
+		points[i].CasesDelta = &d
+	}
+	return resets
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeCasesDelta(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2020, 3, d, 0, 0, 0, 0, time.UTC) }
+	points := []datapoint{
+		{Province: "b", Ts: day(1), Cases: -2},
+		{Province: "a", Ts: day(2), Cases: 5},
+		{Province: "b", Ts: day(2), Cases: 4},
+		{Province: "a", Ts: day(1), Cases: -1},
+		{Province: "a", Ts: day(3), Cases: 3},
+	}
+	resets := computeCasesDelta(points)
+
+	want := []struct {
+		province string
+		delta    int
+	}{
+		{"a", 0}, // starts negative
+		{"a", 6},
+		{"a", 0}, // goes down
+		{"b", 0}, // starts negative, after another series
+		{"b", 6},
+	}
+	for i, w := range want {
+		p := points[i]
+		if p.Province != w.province || p.CasesDelta == nil || *p.CasesDelta != w.delta {
+			t.Errorf("record %d: province %s, delta %v; want %s, %d", i, p.Province, p.CasesDelta, w.province, w.delta)
+		}
+	}
+	if resets != 3 {
+		t.Errorf("resets = %d, want 3", resets)
+	}
+}
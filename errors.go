@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors identifying the kind of a failure. Errors returned by the
+// parser and the upload workers wrap one of them, so callers can tell them
+// apart with errors.Is.
+var (
+	// ErrParse is a record or input that could not be decoded.
+	ErrParse = errors.New("parse error")
+
+	// ErrEnrich is a record whose derived fields could not be resolved.
+	ErrEnrich = errors.New("enrichment error")
+
+	// ErrConnection is a bulk request that never got a response.
+	ErrConnection = errors.New("connection error")
+)
+
+// BulkItemError is a document the cluster rejected.
+type BulkItemError struct {
+	Index  string
+	ID     string
+	Status int
+	Type   string
+	Reason string
+}
+
+func (e BulkItemError) Error() string {
+	return fmt.Sprintf("[%d] %s: %s", e.Status, e.Type, e.Reason)
+}
+
+// BulkError is a bulk request the cluster rejected, either as a whole, in
+// which case Items is empty and Status, Type and Reason describe the
+// response, or in part, with Items holding every rejected document.
+type BulkError struct {
+	BatchID int
+	Status  int
+	Type    string
+	Reason  string
+	Items   []BulkItemError
+}
+
+func (e *BulkError) Error() string {
+	if len(e.Items) == 0 {
+		return fmt.Sprintf("batch %d rejected: [%d] %s: %s", e.BatchID, e.Status, e.Type, e.Reason)
+	}
+	return fmt.Sprintf("batch %d: %d documents rejected, first: %v", e.BatchID, len(e.Items), e.Items[0])
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseErrors(t *testing.T) {
+	_, err := (&parser{}).parseDatapoints(strings.NewReader(`{"Cases":"many"}`))
+	if !errors.Is(err, ErrParse) {
+		t.Errorf("malformed record: err = %v, want ErrParse", err)
+	}
+	if errors.Is(err, ErrEnrich) {
+		t.Errorf("malformed record: err = %v matches ErrEnrich", err)
+	}
+
+	_, err = (&parser{}).parseDatapoints(strings.NewReader(record("Atlantis", 1)))
+	if !errors.Is(err, ErrEnrich) {
+		t.Errorf("unknown province: err = %v, want ErrEnrich", err)
+	}
+}
+
+func TestUploadErrors(t *testing.T) {
+	u := &Uploader{Client: &fakeES{Err: errors.New("connection refused")}, Workers: 1, Index: "covid"}
+	for _, r := range runBatches(context.Background(), u, testPoints(5), 5) {
+		if !errors.Is(r.Err, ErrConnection) {
+			t.Errorf("no response: err = %v, want ErrConnection", r.Err)
+		}
+		var be *BulkError
+		if errors.As(r.Err, &be) {
+			t.Errorf("no response: err = %v is a *BulkError", r.Err)
+		}
+	}
+
+	es := &fakeES{ItemStatus: func(doc map[string]interface{}) int {
+		if doc["cases"].(float64) == 3 {
+			return 400
+		}
+		return 201
+	}}
+	u = &Uploader{Client: es, Workers: 1, Index: "covid"}
+	for _, r := range runBatches(context.Background(), u, testPoints(5), 5) {
+		var be *BulkError
+		if !errors.As(r.Err, &be) {
+			t.Fatalf("rejected document: err = %v, want a *BulkError", r.Err)
+		}
+		if errors.Is(r.Err, ErrConnection) {
+			t.Errorf("rejected document: err = %v matches ErrConnection", r.Err)
+		}
+		if be.BatchID != 1 || len(be.Items) != 1 || be.Items[0].Type != "mapper_parsing_exception" {
+			t.Errorf("BulkError = %+v, want batch 1 with one mapper_parsing_exception", be)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Exit codes. A run that indexes everything it read, or with
+// -max-error-rate and -max-skip-rate raised, stays within them, exits with
+// exitOK. By default any failed document breaks -max-error-rate, while
+// -max-skip-rate allows every record to be skipped. One that completes but
+// fails or skips a larger share of its records exits with exitThresholds; the
+// records that were indexed stay indexed. A run that is aborted, by a
+// configuration, connection or read error or, with -fail-fast, the first bulk
+// error, exits with exitAborted, and so does one that sent records but got
+// none of them indexed, e.g. because the cluster could not be reached. One
+// still running after -max-runtime is killed by the watchdog with
+// exitTimeout. The flag package exits with 2 on a command line it cannot
+// parse.
+const (
+	exitOK         = 0
+	exitAborted    = 1
+	exitThresholds = 3
+	exitTimeout    = 4
+)
+
+// checkQuality returns exitAborted if none of the records in s that were
+// sent got indexed, exitThresholds if the share that failed to index is above
+// -max-error-rate or the share that was skipped is above -max-skip-rate, and
+// exitOK otherwise.
+func checkQuality(s *summary) int {
+	if s.Indexed == 0 && s.Failed > 0 {
+		log.Printf("None of the %d records sent were indexed", s.Failed)
+		return exitAborted
+	}
+	code := exitOK
+	if n := s.Indexed + s.Failed; n > 0 {
+		if rate := float64(s.Failed) / float64(n); rate > *maxErrorRate {
+			log.Printf("Error rate %.2f%% is above -max-error-rate %.2f%%", 100*rate, 100**maxErrorRate)
+			code = exitThresholds
+		}
+	}
+	if n := s.Indexed + s.Failed + s.Skipped; n > 0 {
+		if rate := float64(s.Skipped) / float64(n); rate > *maxSkipRate {
+			log.Printf("Skip rate %.2f%% is above -max-skip-rate %.2f%%", 100*rate, 100**maxSkipRate)
+			code = exitThresholds
+		}
+	}
+	return code
+}
+
+// usage prints the flags, and the exit codes, for -h and a command line the
+// flag package cannot parse.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(out, `
+Exit codes:
+  %d  every record read was indexed, or the failures and skips stayed within
+     -max-error-rate and -max-skip-rate
+  %d  the run was aborted: a configuration, connection or read error, the
+     first bulk error with -fail-fast, or no record sent got indexed
+  2  the command line could not be parsed
+  %d  the run completed but failed or skipped more records than -max-error-rate
+     or -max-skip-rate allow; by default any failed record does. The records
+     indexed stay indexed
+  %d  the run was still going after -max-runtime
+`, exitOK, exitAborted, exitThresholds, exitTimeout)
+}
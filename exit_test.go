@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestCheckQuality(t *testing.T) {
+	defer func(e, s float64) { *maxErrorRate, *maxSkipRate = e, s }(*maxErrorRate, *maxSkipRate)
+
+	for _, tc := range []struct {
+		name                     string
+		errRate, skipRate        float64
+		indexed, failed, skipped int
+		want                     int
+	}{
+		{"clean", 0, 1, 100, 0, 0, exitOK},
+		{"failed by default", 0, 1, 99, 1, 0, exitThresholds},
+		{"failed within rate", 0.05, 1, 99, 1, 0, exitOK},
+		{"failed above rate", 0.05, 1, 90, 10, 0, exitThresholds},
+		{"skipped by default", 0, 1, 50, 0, 50, exitOK},
+		{"skipped above rate", 0, 0.1, 50, 0, 50, exitThresholds},
+		{"nothing indexed", 1, 1, 0, 100, 0, exitAborted},
+		{"nothing read", 0, 0, 0, 0, 0, exitOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			*maxErrorRate, *maxSkipRate = tc.errRate, tc.skipRate
+			s := newSummary()
+			s.Indexed, s.Failed, s.Skipped = tc.indexed, tc.failed, tc.skipped
+			if got := checkQuality(s); got != tc.want {
+				t.Errorf("checkQuality = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// explain prints the mapping the run would create and the bulk request body
+// of its first batch, without contacting the cluster. The mapping goes to
+// stdout as JSON and the body as NDJSON, ready to be pasted into a request;
+// everything else is logged.
+func explain(p *parser) {
+	up := newUploader()
+	l := &loader{up: up, summary: newSummary(), created: make(map[string]bool)}
+
+	n := *batchSize
+	if *limit > 0 && *limit < n {
+		n = *limit
+	}
+	var points []datapoint
+	err := readInput(p, func(d datapoint) error {
+		points = append(points, d)
+		if len(points) == n {
+			return errStop
+		}
+		return nil
+	})
+	if err != nil && err != errStop {
+		log.Fatal("could not read file", err)
+	}
+	reportParser(p)
+	points = l.prepare(points)
+	if *maxPerIndex > 0 {
+		roll := newRollover(*maxPerIndex)
+		for i := range points {
+			points[i].Index = roll.next(up.indexFor(points[i]))
+		}
+	}
+
+	mapping, err := renamedMapping(fieldRenames)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, []byte(mapping), "", "  "); err != nil {
+		log.Fatal(err)
+	}
+	indices := up.targetIndices(points)
+	if len(indices) == 0 {
+		indices = []string{up.Index}
+	}
+	log.Printf("Mapping of %s:", strings.Join(indices, ", "))
+	pretty.WriteByte('\n')
+	os.Stdout.Write(pretty.Bytes())
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	var docs int
+	for _, d := range points {
+		mark := body.Len()
+		if err := up.writeDoc(&body, enc, d); err != nil {
+			log.Fatal(err)
+		}
+		if *maxBulkBytes > 0 && docs > 0 && body.Len() > *maxBulkBytes {
+			body.Truncate(mark)
+			break
+		}
+		docs++
+	}
+
+	path := "/" + url.PathEscape(up.Index) + "/_bulk"
+	if up.Pipeline != "" {
+		path += "?pipeline=" + url.QueryEscape(up.Pipeline)
+	}
+	log.Printf("Body of the first batch, %d records, for POST %s:", docs, path)
+	os.Stdout.Write(body.Bytes())
+}
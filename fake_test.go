@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// fakeES is an in-memory bulkDoer answering bulk requests the way
+// Elasticsearch does. By default it indexes every document; its fields make
+// it fail whole requests, fail single documents or stall.
+type fakeES struct {
+	// Status, if set, is called with the number of each request, counting
+	// from 1, and returns the status of the response. Anything above 299
+	// rejects the whole request, e.g. 429 for a full write queue.
+	Status func(n int) int
+
+	// ItemStatus, if set, returns the status of each document, given its
+	// source. Anything above 299 rejects it.
+	ItemStatus func(doc map[string]interface{}) int
+
+	// Delay stalls every request this long, or until its context is done.
+	// Latency, if set, adds a stall depending on the number of documents in
+	// the request.
+	Delay   time.Duration
+	Latency func(docs int) time.Duration
+
+	// MaxDocs, if positive, rejects requests of more documents with a 429,
+	// as a cluster with a bounded write queue would.
+	MaxDocs int
+
+	// Err, if set, is returned instead of a response, as if the request
+	// never got one, e.g. because it timed out.
+	Err error
+
+	// Started, if set, is sent a value as each request arrives.
+	Started chan<- struct{}
+
+	mu       sync.Mutex
+	requests int
+	docs     []map[string]interface{}
+}
+
+// Perform implements bulkDoer.
+func (f *fakeES) Perform(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+
+	var actions []map[string]bulkMeta
+	var docs []map[string]interface{}
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var action map[string]bulkMeta
+		if err := json.Unmarshal(sc.Bytes(), &action); err != nil {
+			return fakeResponse(400, map[string]interface{}{
+				"error": map[string]string{"type": "parse_exception", "reason": err.Error()},
+			}), nil
+		}
+		if !sc.Scan() {
+			break
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &doc); err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+		docs = append(docs, doc)
+	}
+
+	f.mu.Lock()
+	f.requests++
+	n := f.requests
+	f.mu.Unlock()
+	if f.Started != nil {
+		f.Started <- struct{}{}
+	}
+
+	delay := f.Delay
+	if f.Latency != nil {
+		delay += f.Latency(len(docs))
+	}
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	status := 200
+	if f.Status != nil {
+		status = f.Status(n)
+	}
+	if f.MaxDocs > 0 && len(docs) > f.MaxDocs {
+		status = http.StatusTooManyRequests
+	}
+	if status > 299 {
+		return fakeResponse(status, map[string]interface{}{
+			"error": map[string]string{
+				"type":   "es_rejected_execution_exception",
+				"reason": fmt.Sprintf("rejected execution of request %d", n),
+			},
+			"status": status,
+		}), nil
+	}
+
+	var items []map[string]bulkItem
+	var errs bool
+	for i, action := range actions {
+		doc := docs[i]
+		for op, meta := range action {
+			item := bulkItem{Index: meta.Index, ID: meta.ID, Status: 201}
+			if f.ItemStatus != nil {
+				item.Status = f.ItemStatus(doc)
+			}
+			if item.Status > 299 {
+				errs = true
+				item.Error.Type = "mapper_parsing_exception"
+				if item.Status == http.StatusConflict {
+					item.Error.Type = "version_conflict_engine_exception"
+				}
+				item.Error.Reason = fmt.Sprintf("document %s rejected", meta.ID)
+			} else {
+				f.mu.Lock()
+				f.docs = append(f.docs, doc)
+				f.mu.Unlock()
+			}
+			items = append(items, map[string]bulkItem{op: item})
+		}
+	}
+	return fakeResponse(200, bulkResponse{Errors: errs, Items: items}), nil
+}
+
+// Docs returns the documents indexed so far.
+func (f *fakeES) Docs() []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]interface{}(nil), f.docs...)
+}
+
+// Requests returns the number of requests received so far.
+func (f *fakeES) Requests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+func fakeResponse(status int, v interface{}) *http.Response {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(b)),
+	}
+}
+
+// discardDoer is a bulkDoer that reads and drops every request, answering
+// that nothing went wrong without item details. It keeps benchmarks from
+// measuring the fake rather than the uploader.
+type discardDoer struct{}
+
+func (discardDoer) Perform(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+	}
+	return fakeResponse(200, bulkResponse{}), nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"time"
+)
+
+// fieldMap maps datapoint fields to the source keys they are read from. The
+// fields are named after the datapoint struct, with Lat and Long standing for
+// the two halves of Geo.
+type fieldMap map[string]string
+
+// defaultFields is the layout of the original source data.
+var defaultFields = fieldMap{
+	"Ts":           "Date",
+	"CountryName":  "Country",
+	"CountryCode":  "CountryCode",
+	"Province":     "Province",
+	"ProvinceCode": "ProvinceCode",
+	"City":         "City",
+	"CityCode":     "CityCode",
+	"Lat":          "Lat",
+	"Long":         "Lon",
+	"Cases":        "Cases",
+	"Status":       "Status",
+}
+
+// loadFieldMap reads a JSON object mapping source keys to datapoint fields
+// from f. Fields it doesn't mention keep their default source key.
+func loadFieldMap(f string) (fieldMap, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	var keys map[string]string
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, err
+	}
+
+	m := make(fieldMap, len(defaultFields))
+	for field, key := range defaultFields {
+		m[field] = key
+	}
+	mapped := make(map[string]string)
+	for key, field := range keys {
+		if _, ok := defaultFields[field]; !ok {
+			return nil, fmt.Errorf("key %q: unknown field %q", key, field)
+		}
+		if other, ok := mapped[field]; ok {
+			return nil, fmt.Errorf("field %q is mapped from both %q and %q", field, other, key)
+		}
+		mapped[field] = key
+		m[field] = key
+	}
+	return m, nil
+}
+
+// zonelessLayouts are the layouts accepted for source dates without a zone.
+var zonelessLayouts = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// epochMillisFrom is the magnitude from which an epoch timestamp is taken to
+// be in milliseconds rather than seconds. As seconds it would lie past the
+// year 5000, as milliseconds it is early March 1973.
+const epochMillisFrom = 1e11
+
+// epochTime returns the instant n seconds or, if it is large enough,
+// milliseconds after the Unix epoch.
+func epochTime(n int64) time.Time {
+	if n >= epochMillisFrom || n <= -epochMillisFrom {
+		return time.Unix(n/1000, n%1000*int64(time.Millisecond)).UTC()
+	}
+	return time.Unix(n, 0).UTC()
+}
+
+// epochMinDigits is the fewest digits a date needs to be read as an epoch,
+// whether it is a string or a JSON number. Shorter numbers, such as 20200401,
+// are more likely dates in a compact layout than instants in the first years
+// of 1970, and are rejected rather than silently misread.
+const epochMinDigits = 9
+
+// isEpoch reports whether s is all digits, at least epochMinDigits of them.
+func isEpoch(s string) bool {
+	if len(s) < epochMinDigits {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// numericEpoch returns the instant of a source date given as a JSON number,
+// which must have at least epochMinDigits digits before any fraction.
+func numericEpoch(n float64) (time.Time, error) {
+	if n < math.Pow10(epochMinDigits-1) {
+		return time.Time{}, fmt.Errorf("date %s is too small to be an epoch in seconds or milliseconds", strconv.FormatFloat(n, 'f', -1, 64))
+	}
+	return epochTime(int64(n)), nil
+}
+
+// parseTimestamp parses an RFC 3339 source date, one in a zoneless layout
+// which is taken to be in UTC, or an epoch in seconds or milliseconds, and
+// returns it in UTC so every document is indexed with the same offset.
+func parseTimestamp(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err == nil {
+		return t.UTC(), nil
+	}
+	if isEpoch(s) {
+		if n, nerr := strconv.ParseInt(s, 10, 64); nerr == nil {
+			return epochTime(n), nil
+		}
+	}
+	for _, layout := range zonelessLayouts {
+		if t, zerr := time.ParseInLocation(layout, s, time.UTC); zerr == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// unmarshal parses the source record b into d, reading each field from the
+// key m maps it to. ProvinceCode, City and CityCode are optional.
+func (m fieldMap) unmarshal(b []byte, d *datapoint) error {
+	var s map[string]interface{}
+
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+
+	if n, ok := s[m["Ts"]].(float64); ok {
+		if d.Ts, err = numericEpoch(n); err != nil {
+			return err
+		}
+	} else {
+		date, err := stringField(s, m["Ts"])
+		if err != nil {
+			return err
+		}
+		if d.Ts, err = parseTimestamp(date); err != nil {
+			return err
+		}
+	}
+	if d.CountryName, err = stringField(s, m["CountryName"]); err != nil {
+		return err
+	}
+	if d.CountryCode, err = stringField(s, m["CountryCode"]); err != nil {
+		return err
+	}
+	if d.Province, err = stringField(s, m["Province"]); err != nil {
+		return err
+	}
+
+	if _, ok := s[m["ProvinceCode"]]; ok {
+		if d.ProvinceCode, err = stringField(s, m["ProvinceCode"]); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := s[m["City"]]; ok {
+		if d.City, err = stringField(s, m["City"]); err != nil {
+			return err
+		}
+	}
+	if _, ok := s[m["CityCode"]]; ok {
+		if d.CityCode, err = stringField(s, m["CityCode"]); err != nil {
+			return err
+		}
+	}
+
+	lat, err := stringField(s, m["Lat"])
+	if err != nil {
+		return err
+	}
+	d.Geo.Lat, err = strconv.ParseFloat(lat, 64)
+	if err != nil {
+		return err
+	}
+	lon, err := stringField(s, m["Long"])
+	if err != nil {
+		return err
+	}
+	d.Geo.Long, err = strconv.ParseFloat(lon, 64)
+	if err != nil {
+		return err
+	}
+
+	k := m["Cases"]
+	cases, ok := s[k].(float64)
+	if !ok {
+		return fmt.Errorf("field %q: expected a number, got %T", k, s[k])
+	}
+	d.Cases = int(cases)
+	if d.Status, err = stringField(s, m["Status"]); err != nil {
+		return err
+	}
+
+	return nil
+}
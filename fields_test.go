@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want time.Time
+	}{
+		{"2020-04-01T00:00:00Z", time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"2020-04-01T05:30:00+05:30", time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"2020-04-01T00:00:00-04:00", time.Date(2020, 4, 1, 4, 0, 0, 0, time.UTC)},
+		{"2020-04-01T12:30:15.5Z", time.Date(2020, 4, 1, 12, 30, 15, 5e8, time.UTC)},
+		{"2020-04-01T12:30:15", time.Date(2020, 4, 1, 12, 30, 15, 0, time.UTC)},
+		{"2020-04-01 12:30:15", time.Date(2020, 4, 1, 12, 30, 15, 0, time.UTC)},
+		{"2020-04-01", time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"1585699200", time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"1585699200123", time.Date(2020, 4, 1, 0, 0, 0, 123e6, time.UTC)},
+		{"123456789", time.Date(1973, 11, 29, 21, 33, 9, 0, time.UTC)},
+	} {
+		got, err := parseTimestamp(tc.in)
+		if err != nil {
+			t.Errorf("%s: %v", tc.in, err)
+			continue
+		}
+		if !got.Equal(tc.want) || got.Location() != time.UTC {
+			t.Errorf("%s: got %s, want %s", tc.in, got, tc.want)
+		}
+	}
+
+	// Short or signed numbers are not taken for epochs.
+	for _, in := range []string{"", "April 1st", "2020-04-01T00:00:00+25:00", "20200401", "12345", "-1585699200", "+1585699200"} {
+		if got, err := parseTimestamp(in); err == nil {
+			t.Errorf("%q: got %s, want an error", in, got)
+		}
+	}
+}
+
+func TestParseTimestampEpochs(t *testing.T) {
+	want, err := parseTimestamp("2020-04-01T12:00:00.250Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secs, err := parseTimestamp("1585742400")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secs.Equal(want.Truncate(time.Second)) {
+		t.Errorf("seconds: got %s, want %s", secs, want.Truncate(time.Second))
+	}
+	millis, err := parseTimestamp("1585742400250")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !millis.Equal(want) {
+		t.Errorf("milliseconds: got %s, want %s", millis, want)
+	}
+
+	if _, err := parseTimestamp("20200401"); err == nil {
+		t.Error("20200401: no error, want one rather than a date in 1970")
+	}
+
+	// The same holds for dates given as JSON numbers.
+	var d datapoint
+	if err := defaultFields.unmarshal([]byte(`{"Date":20200401}`), &d); err == nil {
+		t.Error("numeric 20200401: no error, want one rather than a date in 1970")
+	}
+	rec := []byte(`{"Date":1585742400,"Country":"United States of America","CountryCode":"US","Province":"New York","Lat":"40.1","Lon":"-74.2","Cases":1,"Status":"confirmed"}`)
+	if err := defaultFields.unmarshal(rec, &d); err != nil {
+		t.Fatal(err)
+	}
+	if !d.Ts.Equal(secs) {
+		t.Errorf("numeric seconds: got %s, want %s", d.Ts, secs)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// gazetteer maps a country code, province and city name to a city code.
+type gazetteer map[string]string
+
+func gazetteerKey(country, province, city string) string {
+	return strings.ToLower(country + "|" + province + "|" + city)
+}
+
+// lookup returns the city code for the given location, if known.
+func (g gazetteer) lookup(country, province, city string) (string, bool) {
+	code, ok := g[gazetteerKey(country, province, city)]
+	return code, ok
+}
+
+// loadGazetteer reads a CSV file of country_code,province,city,city_code
+// rows. A first row starting with "country_code" is treated as a header.
+func loadGazetteer(f string) (gazetteer, error) {
+	file, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = 4
+	r.TrimLeadingSpace = true
+
+	g := make(gazetteer)
+	for line := 1; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		if line == 1 && strings.EqualFold(rec[0], "country_code") {
+			continue
+		}
+		g[gazetteerKey(rec[0], rec[1], rec[2])] = rec[3]
+	}
+	return g, nil
+}
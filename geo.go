@@ -0,0 +1,143 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/pariz/gountries"
+)
+
+var (
+	countriesOnce sync.Once
+	countries     *gountries.Query
+)
+
+// countryQuery returns the shared gountries query, loading its tables on
+// first use.
+func countryQuery() *gountries.Query {
+	countriesOnce.Do(func() {
+		countries = gountries.New()
+	})
+	return countries
+}
+
+// inBounds reports whether lat and long fall within the bounding box of c.
+// Boxes of countries straddling the antimeridian have a MinLongitude greater
+// than their MaxLongitude.
+func inBounds(c gountries.Country, lat, long float64) bool {
+	b := c.Coordinates
+	if lat < b.MinLatitude || lat > b.MaxLatitude {
+		return false
+	}
+	if b.MinLongitude > b.MaxLongitude {
+		return long >= b.MinLongitude || long <= b.MaxLongitude
+	}
+	return long >= b.MinLongitude && long <= b.MaxLongitude
+}
+
+// territories lists, per country, the overseas territories the source data
+// reports as provinces of that country. gountries gives each of them a
+// bounding box of its own, which the country's box leaves out.
+var territories = map[string][]string{
+	"US": {"PR", "VI", "GU", "MP", "AS", "UM"},
+	"FR": {"GF", "GP", "MQ", "RE", "YT", "PM", "BL", "MF", "PF", "NC", "WF"},
+	"GB": {"BM", "KY", "GI", "FK", "MS", "TC", "VG", "AI", "IM", "JE", "GG"},
+	"NL": {"AW", "CW", "SX", "BQ"},
+	"DK": {"GL", "FO"},
+}
+
+// countryBoxes returns the countries whose bounding boxes together cover the
+// country with the given code and its territories, or nil if gountries
+// doesn't know the code.
+func countryBoxes(q *gountries.Query, code string) []gountries.Country {
+	c, err := q.FindCountryByAlpha(code)
+	if err != nil {
+		return nil
+	}
+	boxes := []gountries.Country{c}
+	for _, t := range territories[c.Alpha2] {
+		if tc, err := q.FindCountryByAlpha(t); err == nil {
+			boxes = append(boxes, tc)
+		}
+	}
+	return boxes
+}
+
+// inAnyBounds reports whether lat and long fall within any of boxes.
+func inAnyBounds(boxes []gountries.Country, lat, long float64) bool {
+	for _, c := range boxes {
+		if inBounds(c, lat, long) {
+			return true
+		}
+	}
+	return false
+}
+
+// geoMismatch is a record whose coordinates lie outside its country.
+type geoMismatch struct {
+	Record datapoint
+
+	// Swapped is set if the coordinates do lie inside the country once
+	// latitude and longitude are exchanged.
+	Swapped bool
+}
+
+// checkGeoCountry compares the coordinates of each of points against the
+// bounding boxes of its country and the country's overseas territories. It
+// returns the records that pass along with those that don't; drop controls
+// whether the latter are left out of the result. Records whose country code
+// gountries doesn't know are passed unchecked. Bounding boxes are coarse: a
+// mismatch is worth a look, and a match proves little.
+func checkGeoCountry(points []datapoint, drop bool) ([]datapoint, []geoMismatch) {
+	q := countryQuery()
+	known := make(map[string][]gountries.Country)
+
+	var mismatches []geoMismatch
+	valid := points[:0]
+	for _, p := range points {
+		boxes, ok := known[p.CountryCode]
+		if !ok {
+			boxes = countryBoxes(q, p.CountryCode)
+			known[p.CountryCode] = boxes
+		}
+		if boxes != nil && !inAnyBounds(boxes, p.Geo.Lat, p.Geo.Long) {
+			mismatches = append(mismatches, geoMismatch{
+				Record:  p,
+				Swapped: inAnyBounds(boxes, p.Geo.Long, p.Geo.Lat),
+			})
+			if drop {
+				continue
+			}
+		}
+		valid = append(valid, p)
+	}
+	return valid, mismatches
+}
+
+// maxReportedMismatches is the number of records outside their country that
+// are listed.
+const maxReportedMismatches = 10
+
+// reportGeoMismatches warns about the n records lying outside their country,
+// listing the first maxReportedMismatches of mismatches.
+func reportGeoMismatches(mismatches []geoMismatch, n int) {
+	if n == 0 {
+		return
+	}
+	log.Printf("Warning: %d records have coordinates outside their country", n)
+	if len(mismatches) > maxReportedMismatches {
+		mismatches = mismatches[:maxReportedMismatches]
+	}
+	for _, m := range mismatches {
+		r := m.Record
+		hint := ""
+		if m.Swapped {
+			hint = " (latitude and longitude look swapped)"
+		}
+		log.Printf("  %s country=%s province=%q lat=%g lon=%g%s",
+			r.Ts.Format("2006-01-02"), r.CountryCode, r.Province, r.Geo.Lat, r.Geo.Long, hint)
+	}
+	if n > len(mismatches) {
+		log.Printf("  ... and %d more", n-len(mismatches))
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestCheckGeoCountry(t *testing.T) {
+	points := []datapoint{
+		{CountryCode: "US", Province: "New York", Geo: geo{Lat: 42.17, Long: -74.95}},
+		{CountryCode: "US", Province: "Puerto Rico", ProvinceCode: "US-PR", Geo: geo{Lat: 18.22, Long: -66.59}},
+		{CountryCode: "US", Province: "Guam", Geo: geo{Lat: 13.44, Long: 144.79}},
+		{CountryCode: "FR", Province: "Reunion", Geo: geo{Lat: -21.12, Long: 55.54}},
+		{CountryCode: "US", Province: "Swapped", Geo: geo{Lat: -74.95, Long: 42.17}},
+		{CountryCode: "DE", Province: "Bavaria", Geo: geo{Lat: 18.22, Long: -66.59}},
+		{CountryCode: "XX", Province: "Unknown", Geo: geo{Lat: 0, Long: 0}},
+	}
+
+	valid, mismatches := checkGeoCountry(points, true)
+	if len(valid) != 5 || len(mismatches) != 2 {
+		t.Fatalf("%d valid, %d mismatches; want 5 and 2", len(valid), len(mismatches))
+	}
+	if m := mismatches[0]; m.Record.Province != "Swapped" || !m.Swapped {
+		t.Errorf("first mismatch %+v, want the swapped record", m)
+	}
+	if m := mismatches[1]; m.Record.Province != "Bavaria" || m.Swapped {
+		t.Errorf("second mismatch %+v, want Bavaria, not swapped", m)
+	}
+}
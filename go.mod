@@ -3,9 +3,9 @@ module github.com/coreyvan/covid
 go 1.14
 
 require (
-	github.com/elastic/go-elasticsearch v0.0.0
 	github.com/elastic/go-elasticsearch/v7 v7.6.0
+	github.com/opensearch-project/opensearch-go v1.0.0
 	github.com/pariz/gountries v0.0.0-20191029140926-233bc78cf5b5
-	github.com/stretchr/testify v1.5.1 // indirect
+	github.com/segmentio/kafka-go v0.4.20
 	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
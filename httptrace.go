@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// traceBodyMax is how much of each request and response body -trace-http logs.
+const traceBodyMax = 2048
+
+// tracingTransport logs every request sent through Next together with its
+// response, redacting credentials.
+type tracingTransport struct {
+	Next http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		reqBody = b
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	}
+	log.Printf("[http] > %s %s %s%s", req.Method, req.URL, traceHeaders(req.Header), truncateBody(reqBody))
+
+	res, err := t.Next.RoundTrip(req)
+	if err != nil {
+		log.Printf("[http] < %s %s: %v", req.Method, req.URL, err)
+		return nil, err
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		log.Printf("[http] < %s %s: %s, reading body: %v", req.Method, req.URL, res.Status, err)
+		return res, nil
+	}
+	log.Printf("[http] < %s %s: %s%s", req.Method, req.URL, res.Status, truncateBody(b))
+	return res, nil
+}
+
+// traceHeaders formats h for the log with the values of credential headers
+// replaced.
+func traceHeaders(h http.Header) string {
+	var keys []string
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		v := strings.Join(h[k], ", ")
+		switch http.CanonicalHeaderKey(k) {
+		case "Authorization", "Proxy-Authorization", "Cookie":
+			v = "[redacted]"
+		}
+		parts = append(parts, k+": "+v)
+	}
+	return "{" + strings.Join(parts, "; ") + "}"
+}
+
+// truncateBody returns b for the log on a line of its own, cut short after
+// traceBodyMax bytes.
+func truncateBody(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	if len(b) <= traceBodyMax {
+		return "\n" + string(b)
+	}
+	return "\n" + string(b[:traceBodyMax]) + "... (" + formatBytes(int64(len(b))) + " in total)"
+}
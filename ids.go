@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// IDGenerator decides the document ID of each record. An empty ID leaves it
+// to the cluster to assign one.
+type IDGenerator interface {
+	ID(d datapoint) string
+}
+
+// autoIDs leaves every ID to the cluster.
+type autoIDs struct{}
+
+func (autoIDs) ID(datapoint) string { return "" }
+
+// compositeIDs derives the ID from the fields identifying a record: its date,
+// location and status. Reloading the same data then overwrites documents
+// instead of duplicating them.
+type compositeIDs struct{}
+
+func (compositeIDs) ID(d datapoint) string {
+	return fmt.Sprintf("%s-%s-%s-%s-%s", d.Ts.UTC().Format("20060102"), d.CountryCode, d.ProvinceCode, d.CityCode, d.Status)
+}
+
+// hashIDs uses the hex SHA-256 of the values of Fields as the ID, giving IDs
+// of a fixed length whatever the fields hold.
+type hashIDs struct {
+	Fields []string
+}
+
+func (h hashIDs) ID(d datapoint) string {
+	sum := sha256.New()
+	for _, f := range h.Fields {
+		v, _ := fieldValue(d, f)
+		sum.Write([]byte(v))
+		sum.Write([]byte{0})
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// fieldIDs uses the value of Field, e.g. an ID carried over from the source,
+// as the ID.
+type fieldIDs struct {
+	Field string
+}
+
+func (f fieldIDs) ID(d datapoint) string {
+	v, _ := fieldValue(d, f.Field)
+	return v
+}
+
+// uuidIDs gives every record a random ID.
+type uuidIDs struct{}
+
+func (uuidIDs) ID(datapoint) string { return newUUID() }
+
+// newIDGenerator returns the IDGenerator called strategy. fields lists the
+// datapoint fields the hash and field strategies use, matched like
+// fieldValue.
+func newIDGenerator(strategy string, fields []string) (IDGenerator, error) {
+	for _, f := range fields {
+		if err := checkField(f); err != nil {
+			return nil, fmt.Errorf("-id-fields: %v", err)
+		}
+	}
+	switch strategy {
+	case "none":
+		return autoIDs{}, nil
+	case "composite":
+		return compositeIDs{}, nil
+	case "hash":
+		if len(fields) == 0 {
+			return nil, errors.New("-id-strategy hash needs at least one -id-fields field")
+		}
+		return hashIDs{Fields: fields}, nil
+	case "field":
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("-id-strategy field needs exactly one -id-fields field, got %d", len(fields))
+		}
+		return fieldIDs{Field: fields[0]}, nil
+	case "uuid":
+		return uuidIDs{}, nil
+	}
+	return nil, fmt.Errorf("unknown -id-strategy %q, expected none, composite, hash, field or uuid", strategy)
+}
+
+// stableIDs reports whether g gives a record the same ID on every run, so
+// reloading it overwrites the document instead of adding another.
+func stableIDs(g IDGenerator) bool {
+	switch g.(type) {
+	case nil, autoIDs, uuidIDs:
+		return false
+	}
+	return true
+}
+
+// idStrategyName returns the -id-strategy in effect: composite with
+// -deterministic-ids unless another one is given, and none without.
+func idStrategyName() string {
+	if *idStrategy != "" {
+		return *idStrategy
+	}
+	if *deterministicIDs {
+		return "composite"
+	}
+	return "none"
+}
+
+// hasIDs reports whether the records of a run are given IDs at all.
+func hasIDs() bool {
+	return idStrategyName() != "none"
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Fatal("could not generate UUID: ", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// duplicate is a document ID assigned to more than one record.
+type duplicate struct {
+	ID      string
+	Count   int
+	Records []datapoint
+}
+
+// findDuplicateIDs returns the IDs shared by more than one of points, with
+// the records sharing them, ordered by ID.
+func findDuplicateIDs(points []datapoint) []duplicate {
+	byID := make(map[string][]datapoint)
+	for _, p := range points {
+		if p.ID != "" {
+			byID[p.ID] = append(byID[p.ID], p)
+		}
+	}
+
+	var dups []duplicate
+	for id, recs := range byID {
+		if len(recs) > 1 {
+			dups = append(dups, duplicate{ID: id, Count: len(recs), Records: recs})
+		}
+	}
+	sort.Slice(dups, func(i, j int) bool { return dups[i].ID < dups[j].ID })
+	return dups
+}
+
+// reportDuplicates warns about each colliding ID and the identifying fields of
+// the records behind it, listing at most ten IDs.
+func reportDuplicates(dups []duplicate) {
+	if len(dups) == 0 {
+		return
+	}
+	log.Printf("Warning: %d document IDs are shared by more than one record", len(dups))
+	for i, d := range dups {
+		if i == 10 {
+			log.Printf("  ... and %d more", len(dups)-i)
+			break
+		}
+		log.Printf("  %s (%d records)", d.ID, d.Count)
+		for _, r := range d.Records {
+			log.Printf("    %s country=%q province=%q city=%q status=%q cases=%d",
+				r.Ts.Format("2006-01-02"), r.CountryName, r.Province, r.City, r.Status, r.Cases)
+		}
+	}
+}
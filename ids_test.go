@@ -0,0 +1,114 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIDStrategies(t *testing.T) {
+	d := datapoint{
+		Ts:           time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC),
+		CountryCode:  "US",
+		ProvinceCode: "US-NY",
+		Province:     "New York",
+		Status:       "confirmed",
+	}
+	other := d
+	other.Status = "deaths"
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	hex := regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+	for _, tc := range []struct {
+		strategy string
+		fields   []string
+		check    func(id string) bool
+		stable   bool
+	}{
+		{"none", nil, func(id string) bool { return id == "" }, false},
+		{"composite", nil, func(id string) bool { return id == "20200401-US-US-NY--confirmed" }, true},
+		{"hash", []string{"@timestamp", "CountryCode", "Status"}, hex.MatchString, true},
+		{"field", []string{"province"}, func(id string) bool { return id == "New York" }, true},
+		{"uuid", nil, uuid.MatchString, false},
+	} {
+		t.Run(tc.strategy, func(t *testing.T) {
+			g, err := newIDGenerator(tc.strategy, tc.fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id := g.ID(d)
+			if !tc.check(id) {
+				t.Errorf("ID = %q", id)
+			}
+			if stableIDs(g) != tc.stable {
+				t.Errorf("stableIDs = %v, want %v", !tc.stable, tc.stable)
+			}
+			if tc.stable && g.ID(d) != id {
+				t.Errorf("second ID %q differs from %q", g.ID(d), id)
+			}
+			if tc.strategy == "uuid" && g.ID(d) == id {
+				t.Errorf("uuid repeated %q", id)
+			}
+		})
+	}
+
+	// Hashes depend on every field listed, and on where one ends and the
+	// next begins.
+	h := hashIDs{Fields: []string{"CountryCode", "Status"}}
+	if h.ID(d) == h.ID(other) {
+		t.Error("hash ignores Status")
+	}
+	a := datapoint{CountryCode: "US", Status: "confirmed"}
+	b := datapoint{CountryCode: "USc", Status: "onfirmed"}
+	if h.ID(a) == h.ID(b) {
+		t.Error("hash runs fields together")
+	}
+}
+
+func TestNewIDGeneratorErrors(t *testing.T) {
+	for _, tc := range []struct {
+		strategy string
+		fields   []string
+		want     string
+	}{
+		{"hash", nil, "needs at least one -id-fields field"},
+		{"field", nil, "needs exactly one -id-fields field, got 0"},
+		{"field", []string{"CountryCode", "Status"}, "needs exactly one -id-fields field, got 2"},
+		{"hash", []string{"CountryCode", "Colour"}, `unknown field "Colour"`},
+		{"hash", []string{"CountryCode", "geo"}, `field "geo" holds more than a single value`},
+		{"sequence", nil, `unknown -id-strategy "sequence"`},
+	} {
+		g, err := newIDGenerator(tc.strategy, tc.fields)
+		if err == nil {
+			t.Errorf("%s %v: got %T, want an error", tc.strategy, tc.fields, g)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s %v: err = %q, want it to mention %q", tc.strategy, tc.fields, err, tc.want)
+		}
+	}
+}
+
+func TestIDStrategyName(t *testing.T) {
+	defer func(s string, det bool) { *idStrategy, *deterministicIDs = s, det }(*idStrategy, *deterministicIDs)
+	for _, tc := range []struct {
+		strategy      string
+		deterministic bool
+		want          string
+	}{
+		{"", false, "none"},
+		{"", true, "composite"},
+		{"hash", true, "hash"},
+		{"none", true, "none"},
+	} {
+		*idStrategy, *deterministicIDs = tc.strategy, tc.deterministic
+		if got := idStrategyName(); got != tc.want {
+			t.Errorf("-id-strategy %q, -deterministic-ids %v: got %s, want %s", tc.strategy, tc.deterministic, got, tc.want)
+		}
+		if hasIDs() != (tc.want != "none") {
+			t.Errorf("-id-strategy %q, -deterministic-ids %v: hasIDs = %v", tc.strategy, tc.deterministic, hasIDs())
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+// indexMapping is the mapping shared by every index the tool creates.
+const indexMapping = `{
+  "mappings": {
+    "properties": {
+      "@timestamp":    { "type": "date" },
+      "event_date":    { "type": "date" },
+      "country_name":  { "type": "keyword" },
+      "country_code":  { "type": "keyword" },
+      "province":      { "type": "keyword" },
+      "province_code": { "type": "keyword" },
+      "city":          { "type": "keyword" },
+      "city_code":     { "type": "keyword" },
+      "geo":           { "type": "geo_point" },
+      "cases":         { "type": "integer" },
+      "cases_delta":   { "type": "integer" },
+      "status":        { "type": "keyword" },
+      "run_id":        { "type": "keyword" }
+    }
+  }
+}`
+
+// renamedMapping returns indexMapping with its fields renamed by r.
+func renamedMapping(r renames) (string, error) {
+	if len(r) == 0 {
+		return indexMapping, nil
+	}
+	var m struct {
+		Mappings struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"mappings"`
+	}
+	if err := json.Unmarshal([]byte(indexMapping), &m); err != nil {
+		return "", err
+	}
+	r.apply(m.Mappings.Properties)
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// statusIndex returns the name of the per-status index for base, e.g.
+// "covid-confirmed" for base "covid" and status "Confirmed".
+func statusIndex(base, status string) string {
+	s := strings.ToLower(strings.TrimSpace(status))
+	s = strings.Join(strings.Fields(s), "-")
+	if s == "" {
+		return base
+	}
+	return base + "-" + s
+}
+
+// rollover numbers indices by size: the first Max documents written to a
+// base index go to <base>-000001, the next Max to <base>-000002 and so on.
+// Counts are kept per base index and span every load of a run.
+type rollover struct {
+	Max    int
+	counts map[string]int
+}
+
+func newRollover(max int) *rollover {
+	return &rollover{Max: max, counts: make(map[string]int)}
+}
+
+// next returns the index the next document bound for base goes to.
+func (r *rollover) next(base string) string {
+	n := r.counts[base]
+	r.counts[base]++
+	return fmt.Sprintf("%s-%06d", base, n/r.Max+1)
+}
+
+// targetIndices returns the sorted set of indices points will be written to.
+func (u *Uploader) targetIndices(points []datapoint) []string {
+	seen := make(map[string]bool)
+	for _, p := range points {
+		seen[u.indexFor(p)] = true
+	}
+	var idx []string
+	for k := range seen {
+		idx = append(idx, k)
+	}
+	sort.Strings(idx)
+	return idx
+}
+
+// indexExists reports whether name exists.
+func indexExists(t esapi.Transport, name string) (bool, error) {
+	res, err := esapi.IndicesExistsRequest{Index: []string{name}}.Do(context.Background(), t)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	return res.StatusCode == 200, nil
+}
+
+// createIndex creates name with mapping unless it already exists.
+func createIndex(t esapi.Transport, name, mapping string) error {
+	exists, err := indexExists(t, name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Printf("Index %s already exists", name)
+		return nil
+	}
+	return putIndex(t, name, mapping)
+}
+
+// putIndex creates name with the given settings and mappings body.
+func putIndex(t esapi.Transport, name, body string) error {
+	res, err := esapi.IndicesCreateRequest{
+		Index: name,
+		Body:  strings.NewReader(body),
+	}.Do(context.Background(), t)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("could not create index %s: %s", name, res.String())
+	}
+	log.Printf("Created index %s", name)
+	return nil
+}
+
+// refreshIndices refreshes names, making every document indexed into them so
+// far visible to search.
+func refreshIndices(t esapi.Transport, names []string) error {
+	res, err := esapi.IndicesRefreshRequest{Index: names}.Do(context.Background(), t)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("could not refresh %s: %s", strings.Join(names, ", "), res.String())
+	}
+	return nil
+}
+
+// aliasIndices returns the indices alias currently points to.
+func aliasIndices(t esapi.Transport, alias string) ([]string, error) {
+	res, err := esapi.IndicesGetAliasRequest{Name: []string{alias}}.Do(context.Background(), t)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("could not get alias %s: %s", alias, res.String())
+	}
+
+	var m map[string]json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+	var idx []string
+	for k := range m {
+		idx = append(idx, k)
+	}
+	sort.Strings(idx)
+	return idx, nil
+}
+
+// setupWriteAlias makes alias the write alias of index, creating index with
+// mapping if needed. A new index and its alias are created in a single
+// request so the alias never points at a half set up index. If alias already
+// points at other indices setupWriteAlias refuses unless force is set, in
+// which case alias is moved to index atomically.
+func setupWriteAlias(t esapi.Transport, index, alias, mapping string, force bool) error {
+	current, err := aliasIndices(t, alias)
+	if err != nil {
+		return err
+	}
+	var others []string
+	for _, idx := range current {
+		if idx != index {
+			others = append(others, idx)
+		}
+	}
+	if len(others) > 0 && !force {
+		return fmt.Errorf("alias %s already points to %s, use -force-alias to move it to %s",
+			alias, strings.Join(others, ", "), index)
+	}
+
+	exists, err := indexExists(t, index)
+	if err != nil {
+		return err
+	}
+	if !exists && len(others) == 0 {
+		var body map[string]interface{}
+		if err := json.Unmarshal([]byte(mapping), &body); err != nil {
+			return err
+		}
+		body["aliases"] = map[string]interface{}{
+			alias: map[string]bool{"is_write_index": true},
+		}
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		return putIndex(t, index, string(b))
+	}
+
+	if !exists {
+		if err := putIndex(t, index, mapping); err != nil {
+			return err
+		}
+	} else if len(others) == 0 && len(current) > 0 {
+		log.Printf("Alias %s already points to %s", alias, index)
+		return nil
+	}
+
+	var actions []map[string]interface{}
+	for _, idx := range others {
+		actions = append(actions, map[string]interface{}{
+			"remove": map[string]string{"index": idx, "alias": alias},
+		})
+	}
+	actions = append(actions, map[string]interface{}{
+		"add": map[string]interface{}{"index": index, "alias": alias, "is_write_index": true},
+	})
+	b, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+
+	res, err := esapi.IndicesUpdateAliasesRequest{Body: bytes.NewReader(b)}.Do(context.Background(), t)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("could not update alias %s: %s", alias, res.String())
+	}
+	log.Printf("Pointed alias %s at %s", alias, index)
+	return nil
+}
+
+type mappingProperties struct {
+	Properties map[string]struct {
+		Type string `json:"type"`
+	} `json:"properties"`
+}
+
+// expectedFieldTypes returns the field types declared in mapping.
+func expectedFieldTypes(mapping string) (map[string]string, error) {
+	var m struct {
+		Mappings mappingProperties `json:"mappings"`
+	}
+	if err := json.Unmarshal([]byte(mapping), &m); err != nil {
+		return nil, err
+	}
+	types := make(map[string]string)
+	for f, p := range m.Mappings.Properties {
+		types[f] = p.Type
+	}
+	return types, nil
+}
+
+// validateMapping compares the mapping of index, which may be an alias or a
+// pattern, against mapping. It returns a description of every field that is
+// mapped with a different type or, unless it is among unwritten, the fields
+// this run leaves out, is missing. Missing unwritten fields are returned as
+// warnings instead: an index created before they existed is fine as long as
+// nothing writes them.
+func validateMapping(t esapi.Transport, index, mapping string, unwritten map[string]bool) (problems, warnings []string, err error) {
+	expected, err := expectedFieldTypes(mapping)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := esapi.IndicesGetMappingRequest{Index: []string{index}}.Do(context.Background(), t)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, nil, fmt.Errorf("could not get mapping of %s: %s", index, res.String())
+	}
+
+	var got map[string]struct {
+		Mappings mappingProperties `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+		return nil, nil, err
+	}
+
+	var names []string
+	for name := range got {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var fields []string
+	for f := range expected {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+
+	for _, name := range names {
+		props := got[name].Mappings.Properties
+		for _, f := range fields {
+			p, ok := props[f]
+			switch {
+			case !ok && unwritten[f]:
+				warnings = append(warnings, fmt.Sprintf("%s: field %s is not mapped, expected %s (not written by this run)", name, f, expected[f]))
+			case !ok:
+				problems = append(problems, fmt.Sprintf("%s: field %s is not mapped, expected %s", name, f, expected[f]))
+			case p.Type != expected[f]:
+				typ := p.Type
+				if typ == "" {
+					typ = "object"
+				}
+				problems = append(problems, fmt.Sprintf("%s: field %s is mapped as %s, expected %s", name, f, typ, expected[f]))
+			}
+		}
+	}
+	return problems, warnings, nil
+}
+
+// indexInfo is a row of the cat indices API.
+type indexInfo struct {
+	Index     string `json:"index"`
+	DocsCount string `json:"docs.count"`
+	StoreSize string `json:"store.size"`
+}
+
+// listIndices returns the indices matching pattern, sorted by name.
+func listIndices(t esapi.Transport, pattern string) ([]indexInfo, error) {
+	res, err := esapi.CatIndicesRequest{
+		Index:  []string{pattern},
+		Format: "json",
+		H:      []string{"index", "docs.count", "store.size"},
+		S:      []string{"index"},
+	}.Do(context.Background(), t)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("could not list indices %s: %s", pattern, res.String())
+	}
+
+	var idx []indexInfo
+	if err := json.NewDecoder(res.Body).Decode(&idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// pipelineExists reports whether the ingest pipeline id is defined.
+func pipelineExists(t esapi.Transport, id string) (bool, error) {
+	res, err := esapi.IngestGetPipelineRequest{PipelineID: id}.Do(context.Background(), t)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return false, nil
+	}
+	if res.IsError() {
+		return false, fmt.Errorf("could not get pipeline %s: %s", id, res.String())
+	}
+	return true, nil
+}
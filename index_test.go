@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIndexMappingCoversDocuments(t *testing.T) {
+	var m struct {
+		Mappings struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"mappings"`
+	}
+	if err := json.Unmarshal([]byte(indexMapping), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	// A document with every optional field set.
+	ts := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	delta := 1
+	b, err := json.Marshal(datapoint{Ts: ts, EventDate: &ts, CasesDelta: &delta, RunID: "run"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	for field := range doc {
+		if _, ok := m.Mappings.Properties[field]; !ok {
+			t.Errorf("field %s is not in the mapping", field)
+		}
+	}
+}
+
+// mappingDoer answers every request with the mapping of an index.
+type mappingDoer struct {
+	mapping map[string]interface{}
+}
+
+func (m mappingDoer) Perform(*http.Request) (*http.Response, error) {
+	return fakeResponse(200, m.mapping), nil
+}
+
+func TestValidateMappingOldIndex(t *testing.T) {
+	// An index created before event_date, cases_delta and run_id were mapped.
+	props := map[string]interface{}{}
+	for _, f := range []string{"country_name", "country_code", "province", "province_code", "city", "city_code", "status"} {
+		props[f] = map[string]string{"type": "keyword"}
+	}
+	props["@timestamp"] = map[string]string{"type": "date"}
+	props["cases"] = map[string]string{"type": "integer"}
+	props["geo"] = map[string]string{"type": "geo_point"}
+	old := mappingDoer{map[string]interface{}{
+		"covid": map[string]interface{}{"mappings": map[string]interface{}{"properties": props}},
+	}}
+	all := map[string]bool{"event_date": true, "cases_delta": true, "run_id": true}
+
+	problems, warnings, err := validateMapping(old, "covid", indexMapping, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 || len(warnings) != 3 {
+		t.Errorf("problems %q, warnings %q; want none and three", problems, warnings)
+	}
+
+	// A run writing cases_delta needs it mapped.
+	problems, _, err = validateMapping(old, "covid", indexMapping, map[string]bool{"event_date": true, "run_id": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "cases_delta") {
+		t.Errorf("problems %q, want cases_delta not mapped", problems)
+	}
+
+	// A conflicting type fails even for a field the run doesn't write.
+	props["run_id"] = map[string]string{"type": "text"}
+	problems, _, err = validateMapping(old, "covid", indexMapping, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "run_id is mapped as text") {
+		t.Errorf("problems %q, want run_id mapped as text", problems)
+	}
+}
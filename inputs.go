@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// inputFiles returns the files named by -input. A directory stands for the
+// regular files directly inside it and a glob pattern for the regular files
+// matching it, in name order, and with a non-zero since only those modified
+// after it are included.
+func inputFiles(input string, since time.Time) ([]string, error) {
+	if strings.ContainsAny(input, "*?[") {
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, m := range matches {
+			fi, err := os.Stat(m)
+			if err != nil {
+				return nil, err
+			}
+			if fi.Mode().IsRegular() && fi.ModTime().After(since) {
+				files = append(files, m)
+			}
+		}
+		return files, nil
+	}
+
+	fi, err := os.Stat(input)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{input}, nil
+	}
+
+	entries, err := ioutil.ReadDir(input)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || !e.ModTime().After(since) {
+			continue
+		}
+		files = append(files, filepath.Join(input, e.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readMarker returns the time recorded in the marker file f, or the zero time
+// if f doesn't exist yet.
+func readMarker(f string) (time.Time, error) {
+	data, err := ioutil.ReadFile(f)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+}
+
+// writeMarker records t in the marker file f.
+func writeMarker(f string, t time.Time) error {
+	return ioutil.WriteFile(f, []byte(t.UTC().Format(time.RFC3339Nano)+"\n"), 0644)
+}
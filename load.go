@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// loader prepares sets of datapoints and uploads them, adding the results to
+// a shared summary. The first send starts the batcher and the sink's workers,
+// which every later send feeds until wait, so that with -max-memory the
+// chunks of a run share a single pool instead of draining it between them.
+type loader struct {
+	up      *Uploader
+	sink    Sink
+	mapping string
+	summary *summary
+
+	// rollover, if set, spreads the documents of each target index over a
+	// series of numbered indices.
+	rollover *rollover
+
+	// ctx carries the span of the run, if it is traced.
+	ctx context.Context
+
+	// created records the indices already created with -create-index.
+	created map[string]bool
+
+	// invalid and mismatched count the records check found invalid or
+	// outside their country since the last report, and mismatches holds the
+	// first of the latter.
+	invalid    validation
+	mismatched int
+	mismatches []geoMismatch
+
+	// in feeds the batcher of the running pipeline, if any. stop is done,
+	// and send stops feeding it, once -fail-fast has seen a failure.
+	in     chan datapoint
+	stop   context.Context
+	cancel context.CancelFunc
+
+	// done is closed once every result of the pipeline is in the summary.
+	// Until then failed, the first failed batch's error with -fail-fast, and
+	// sent, the records the results account for, belong to the goroutine
+	// collecting them. queued counts the records given to send.
+	done         chan struct{}
+	failed       error
+	queued, sent int
+}
+
+// check validates each of points on its own, leaving out the records that
+// -skip-invalid and -drop-geo-mismatches drop. What it finds is counted until
+// the next report, so that records streamed one at a time are reported
+// together.
+func (l *loader) check(points []datapoint) []datapoint {
+	points, v, err := validateRequired(points, splitList(*requiredFields), *skipInvalid)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l.invalid.add(v)
+	if *skipInvalid {
+		for i := 0; i < v.Invalid; i++ {
+			l.up.recordSkipped("missing required fields")
+		}
+	}
+
+	if *checkGeo {
+		var mismatches []geoMismatch
+		points, mismatches = checkGeoCountry(points, *dropGeo)
+		for _, m := range mismatches {
+			if len(l.mismatches) < maxReportedMismatches {
+				l.mismatches = append(l.mismatches, m)
+			}
+			l.mismatched++
+			if *dropGeo {
+				l.up.recordSkipped("coordinates outside country")
+			}
+		}
+	}
+	return points
+}
+
+// report logs what check found since the last report and adds the records it
+// dropped to the summary. With -strict it exits if any record was invalid.
+func (l *loader) report() {
+	v := l.invalid
+	v.report()
+	if *skipInvalid {
+		l.summary.Skipped += v.Invalid
+	}
+	if *strict && v.Invalid > 0 {
+		log.Fatalf("%d records are missing required fields", v.Invalid)
+	}
+	reportGeoMismatches(l.mismatches, l.mismatched)
+	if *dropGeo {
+		l.summary.Skipped += l.mismatched
+	}
+	l.invalid = validation{}
+	l.mismatches, l.mismatched = nil, 0
+}
+
+// prepare checks points and applies the transforms that need every record at
+// hand: document IDs and duplicate detection, case deltas and sorting.
+func (l *loader) prepare(points []datapoint) []datapoint {
+	points = l.check(points)
+	l.report()
+
+	if hasIDs() {
+		for i := range points {
+			points[i].ID = l.up.IDs.ID(points[i])
+		}
+		dups := findDuplicateIDs(points)
+		reportDuplicates(dups)
+		if *strict && len(dups) > 0 {
+			log.Fatalf("%d document IDs are shared by more than one record", len(dups))
+		}
+	}
+
+	if *casesDelta {
+		if resets := computeCasesDelta(points); resets > 0 {
+			log.Printf("Warning: %d series resets clamped to a delta of 0", resets)
+		}
+	}
+
+	if *sortPoints {
+		sortByTimestamp(points)
+	}
+	return points
+}
+
+// load uploads points and waits for every batch to finish, returning what
+// wait returns.
+func (l *loader) load(points []datapoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+	log.Println("Number of records:", len(points))
+	if !*adaptiveBatch {
+		numBatches := int(math.Ceil(float64(len(points)) / float64(*batchSize)))
+		log.Println("Number of batches:", numBatches)
+	}
+	l.send(points) // on a failure, wait returns its error
+	return l.wait()
+}
+
+// send feeds points to the pipeline, starting it first if need be, and
+// returns once the batcher has taken all of them. It returns errStop without
+// sending the rest if the pipeline has stopped on a failure; wait then
+// returns the failure. send must not be called concurrently.
+func (l *loader) send(points []datapoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+	if l.in == nil {
+		l.start()
+	}
+	l.queued += len(points)
+
+	if l.rollover != nil {
+		for i := range points {
+			points[i].Index = l.rollover.next(l.up.indexFor(points[i]))
+		}
+	}
+
+	// Per-status and rolled-over indices are named by the run, so they are
+	// always created with the mapping rather than left to dynamic mapping,
+	// which would map geo as an object.
+	if l.up.Client != nil && ((*createIndices && *alias == "") || l.rollover != nil || l.up.IndexPerStatus) {
+		for _, idx := range l.up.targetIndices(points) {
+			if l.created[idx] {
+				continue
+			}
+			if err := createIndex(l.up.Client, idx, l.mapping); err != nil {
+				log.Fatal(err)
+			}
+			l.created[idx] = true
+		}
+	}
+
+	for _, p := range points {
+		select {
+		case l.in <- p:
+		case <-l.stop.Done():
+			return errStop
+		}
+	}
+	return nil
+}
+
+// start starts the batcher and the sink's workers, and a goroutine adding
+// their results to the summary. With -fail-fast it stops the batcher at the
+// first failed document: no further batches are queued, while those already
+// sent get their response and count as usual.
+func (l *loader) start() {
+	parent := l.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	// The batcher runs on a context of its own, so that stopping on a
+	// failure ends the queue without abandoning the requests already in
+	// flight.
+	l.stop, l.cancel = context.WithCancel(parent)
+	l.in = make(chan datapoint)
+	l.done = make(chan struct{})
+	l.failed, l.queued, l.sent = nil, 0, 0
+
+	q := make(chan batch)
+	results := l.sink.Run(parent, q)
+
+	sizer := newBatchSizer(*batchSize, *minBatchSize, *maxBatchSize, *adaptiveBatch)
+	b := &batcher{
+		Sizer:         sizer,
+		MaxBytes:      *maxBulkBytes,
+		FlushInterval: *flushInterval,
+		SizeOf:        l.up.encodedSize,
+		LogEvery:      *logBatchesEvery,
+	}
+	go b.run(l.stop, l.in, q)
+
+	go func() {
+		defer close(l.done)
+		var done, indexed, failures int
+		for r := range results {
+			sizer.Observe(r)
+			l.summary.add(r)
+			l.sent += r.Indexed + r.Failed
+			if l.up.IgnoreConflicts || l.up.VersionField != "" {
+				l.sent += r.Conflicts
+			}
+			if *logBatchesEvery > 1 {
+				done++
+				indexed += r.Indexed
+				failures += r.Failed
+				if done%*logBatchesEvery == 0 {
+					log.Printf("%d batches done, %d records indexed and %d failed in the last %d",
+						done, indexed, failures, *logBatchesEvery)
+					indexed, failures = 0, 0
+				}
+			}
+			if *failFast && r.Err != nil && l.failed == nil {
+				l.failed = r.Err
+				l.cancel()
+			}
+		}
+	}()
+}
+
+// wait ends the input of the pipeline and waits for every batch to finish.
+// With -fail-fast it returns the error of the batch the pipeline stopped on.
+// The records given to send but never sent are added to the summary's
+// Remaining. A later send starts a new pipeline.
+func (l *loader) wait() error {
+	if l.in == nil {
+		return nil
+	}
+	close(l.in)
+	<-l.done
+	l.cancel()
+	l.in = nil
+	l.summary.Remaining += l.queued - l.sent
+	return l.failed
+}
+
+// refresh refreshes every index documents were written to during the run,
+// so they can be searched as soon as the run ends.
+func (l *loader) refresh() {
+	if l.up.Client == nil || len(l.summary.Indices) == 0 {
+		return
+	}
+	var names []string
+	for idx := range l.summary.Indices {
+		names = append(names, idx)
+	}
+	sort.Strings(names)
+
+	start := time.Now()
+	if err := refreshIndices(l.up.Client, names); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Refreshed %d indices in %s", len(names), time.Since(start).Round(time.Millisecond))
+}
+
+// close closes the sink, if it holds connections of its own, once the run is
+// done with it.
+func (l *loader) close() {
+	c, ok := l.sink.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil {
+		log.Printf("Warning: could not close the sink: %v", err)
+	}
+}
+
+// recordMemory is the approximate number of bytes a buffered record costs,
+// counting the datapoint itself, its strings and its share of a bulk body.
+const recordMemory = 1024
+
+// chunkSize returns how many records fit in maxMemory MiB.
+func chunkSize(maxMemory int) int {
+	n := maxMemory * 1024 * 1024 / recordMemory
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadFailFastKeepsInFlightBatches(t *testing.T) {
+	defer func(ff bool, size int) { *failFast, *batchSize = ff, size }(*failFast, *batchSize)
+	*failFast, *batchSize = true, 10
+
+	// The first document fails. Every request takes a while, so the second
+	// batch is in flight by the time the first one's response is in.
+	es := &fakeES{
+		ItemStatus: func(doc map[string]interface{}) int {
+			if doc["cases"].(float64) == 0 {
+				return 400
+			}
+			return 201
+		},
+		Delay: 20 * time.Millisecond,
+	}
+	up := &Uploader{Client: es, Workers: 2, Index: "covid"}
+	l := &loader{up: up, sink: up, summary: newSummary(), created: make(map[string]bool)}
+
+	err := l.load(testPoints(100))
+	var be *BulkError
+	if !errors.As(err, &be) || be.BatchID != 1 {
+		t.Fatalf("err = %v, want the *BulkError of batch 1", err)
+	}
+	s := l.summary
+	if s.Failed != 1 {
+		t.Errorf("failed %d, want only the rejected document", s.Failed)
+	}
+	if s.Indexed < 19 {
+		t.Errorf("indexed %d, want at least the 19 documents of the first two batches", s.Indexed)
+	}
+	if s.Remaining == 0 || s.Indexed+s.Failed+s.Remaining != 100 {
+		t.Errorf("indexed %d, failed %d, remaining %d; want them to add up to 100 with some remaining",
+			s.Indexed, s.Failed, s.Remaining)
+	}
+}
+
+// closingSink is a Sink recording whether it was closed.
+type closingSink struct {
+	Sink
+	closed int
+}
+
+func (s *closingSink) Close() error {
+	s.closed++
+	return nil
+}
+
+// countingSink is a Sink counting how often it was started.
+type countingSink struct {
+	Sink
+	runs int
+}
+
+func (s *countingSink) Run(ctx context.Context, q <-chan batch) <-chan batchResult {
+	s.runs++
+	return s.Sink.Run(ctx, q)
+}
+
+func TestLoaderSharesPool(t *testing.T) {
+	defer func(size int) { *batchSize = size }(*batchSize)
+	*batchSize = 10
+
+	es := &fakeES{}
+	up := &Uploader{Client: es, Workers: 2, Index: "covid"}
+	sink := &countingSink{Sink: up}
+	l := &loader{up: up, sink: sink, summary: newSummary(), created: make(map[string]bool)}
+	for i := 0; i < 5; i++ {
+		if err := l.send(testPoints(25)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.wait(); err != nil {
+		t.Fatal(err)
+	}
+	if sink.runs != 1 {
+		t.Errorf("sink started %d times, want once for every send", sink.runs)
+	}
+	if s := l.summary; s.Indexed != 125 || s.Remaining != 0 {
+		t.Errorf("indexed %d, remaining %d; want 125 and none", s.Indexed, s.Remaining)
+	}
+	// Batches span the sends rather than ending with each of them.
+	if n := es.Requests(); n != 13 {
+		t.Errorf("%d bulk requests, want 13", n)
+	}
+}
+
+func TestLoaderClosesSink(t *testing.T) {
+	up := &Uploader{Client: &fakeES{}, Workers: 1, Index: "covid"}
+	sink := &closingSink{Sink: up}
+	l := &loader{up: up, sink: sink, summary: newSummary(), created: make(map[string]bool)}
+	if err := l.load(testPoints(10)); err != nil {
+		t.Fatal(err)
+	}
+	l.close()
+	if sink.closed != 1 {
+		t.Errorf("sink closed %d times, want once", sink.closed)
+	}
+
+	// The Elasticsearch sink holds no connections of its own.
+	(&loader{sink: up}).close()
+
+	k := newKafkaSink(up, []string{"localhost:9092"}, "covid")
+	if err := k.Close(); err != nil {
+		t.Errorf("closing an unused kafka sink: %v", err)
+	}
+}
+
+// indexDoer is a fakeES that also answers index requests: no index exists
+// until it is created.
+type indexDoer struct {
+	fakeES
+
+	mu      sync.Mutex
+	created []string
+}
+
+func (d *indexDoer) Perform(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/_bulk") {
+		return d.fakeES.Perform(req)
+	}
+	name := strings.Trim(req.URL.Path, "/")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch req.Method {
+	case http.MethodHead:
+		for _, c := range d.created {
+			if c == name {
+				return fakeResponse(200, nil), nil
+			}
+		}
+		return fakeResponse(404, nil), nil
+	case http.MethodPut:
+		d.created = append(d.created, name)
+		return fakeResponse(200, map[string]bool{"acknowledged": true}), nil
+	}
+	return fakeResponse(400, nil), nil
+}
+
+func TestLoadCreatesStatusIndices(t *testing.T) {
+	es := &indexDoer{}
+	up := &Uploader{Client: es, Workers: 1, Index: "covid", IndexPerStatus: true}
+	l := &loader{up: up, sink: up, mapping: indexMapping, summary: newSummary(), created: make(map[string]bool)}
+
+	points := testPoints(10)
+	for i := range points {
+		points[i].Status = "confirmed"
+		if i%2 == 0 {
+			points[i].Status = "deaths"
+		}
+	}
+	if err := l.load(points); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.load(points); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(es.created)
+	if want := []string{"covid-confirmed", "covid-deaths"}; strings.Join(es.created, ",") != strings.Join(want, ",") {
+		t.Errorf("created %q, want %q once each", es.created, want)
+	}
+}
@@ -4,42 +4,551 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
-	"math"
-	"strconv"
+	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
-	"github.com/elastic/go-elasticsearch/esapi"
 	"github.com/elastic/go-elasticsearch/v7"
-	"github.com/pariz/gountries"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/opensearch-project/opensearch-go"
 )
 
+var (
+	input        = flag.String("input", "us.data", "file, directory or glob pattern of files to read records from, or - for stdin")
+	sinceFile    = flag.String("since-file", "", "marker file holding the time of the last successful run; only files modified after it are read from an -input directory or pattern")
+	fieldMapFile = flag.String("field-map", "", "JSON file mapping source keys to datapoint fields, for feeds that don't use the default keys")
+	limit        = flag.Int("limit", 0, "index at most this many records (0 for all)")
+
+	// The Go runtime, the gountries tables and in-flight bulk bodies come on
+	// top of the buffered records, so expect RSS of roughly twice -max-memory
+	// plus some 50 MiB.
+	maxMemory = flag.Int("max-memory", 0, "when -sort, -cases-delta, -strict or document IDs need the records buffered, buffer roughly at most this many MiB of them, loading the input in chunks (0 to buffer everything); other runs upload records as they are read")
+
+	// Sorting needs every record in memory at once, so it is only done when
+	// asked for now that input is streamed.
+	sortPoints = flag.Bool("sort", false, "sort records by timestamp before indexing (buffers all records in memory)")
+
+	inputWorkers   = flag.Int("input-workers", 4, "number of input files read at once when -input names several")
+	parseWorkers   = flag.Int("parse-workers", 1, "number of records parsed and enriched concurrently, independent of -workers")
+	skipBadRecords = flag.Bool("skip-bad-records", false, "log and skip records that cannot be parsed instead of failing")
+	maxBadRecords  = flag.Int("max-bad-records", 100, "give up after skipping this many bad records (0 for no limit)")
+
+	printUnresolved = flag.Bool("print-unresolved", false, "keep records whose province doesn't resolve to a code and list those provinces with their record counts once the input is read")
+	warnFuture      = flag.Bool("warn-on-future-dates", false, "count and warn about records dated more than -future-tolerance from now")
+	futureTolerance = flag.Duration("future-tolerance", 24*time.Hour, "how far in the future a record may be dated before -warn-on-future-dates flags it")
+	dropFuture      = flag.Bool("drop-future", false, "drop records dated more than -future-tolerance from now; implies -warn-on-future-dates")
+	maxAge          = flag.Duration("max-age", 0, "drop records dated more than this long before now, e.g. 2160h for the last 90 days (0 for no limit)")
+	onCodeMismatch  = flag.String("on-code-mismatch", "blank", "what to do with a province code belonging to another country than the record: blank, keep or fail")
+	normalizeWS     = flag.Bool("normalize-whitespace", false, "trim string fields and collapse runs of whitespace, including non-breaking spaces, before resolving province codes")
+	noEnrich        = flag.Bool("no-enrich", false, "skip province code resolution and index ProvinceCode as found in the source")
+	provinceCache   = flag.Int("province-cache", 1000, "number of resolved province codes to cache (0 to disable)")
+	overridesFile   = flag.String("overrides", "", "JSON file mapping province names to province codes, applied on top of the built-in overrides")
+	overridesIndex  = flag.String("overrides-index", "", "index holding province overrides as {province, province_code} documents, applied last")
+	resolveCity     = flag.String("resolve-city", "", "CSV gazetteer of country_code,province,city,city_code used to fill in missing city codes")
+
+	requiredFields = flag.String("required", "CountryName,Status", "comma separated fields that must be non-empty in every record")
+	skipInvalid    = flag.Bool("skip-invalid", false, "drop records missing a required field instead of indexing them")
+	checkGeo       = flag.Bool("check-geo-country", false, "warn about records whose coordinates lie outside the bounding boxes of their country and its territories")
+	dropGeo        = flag.Bool("drop-geo-mismatches", false, "with -check-geo-country, drop records whose coordinates lie outside their country")
+	strict         = flag.Bool("strict", false, "fail the run if any record is missing a required field or shares its ID with another")
+
+	casesDelta = flag.Bool("cases-delta", false, "add cases_delta, the change in cases since the previous day of the same location and status")
+
+	failFast     = flag.Bool("fail-fast", false, "stop at the first document the cluster fails to index and exit non-zero")
+	maxErrorRate = flag.Float64("max-error-rate", 0, "exit with status 3 if more than this share of records, from 0 to 1, failed to index")
+	maxSkipRate  = flag.Float64("max-skip-rate", 1, "exit with status 3 if more than this share of records, from 0 to 1, was skipped as malformed or invalid; records dropped by -max-age or -drop-future don't count")
+
+	versionField     = flag.String("external-version-field", "", "datapoint field, e.g. @timestamp, used as the external version of each document so older reloads never overwrite newer documents; requires -deterministic-ids or a stable -id-strategy")
+	deterministicIDs = flag.Bool("deterministic-ids", false, "derive document IDs from date, location and status so reloads overwrite instead of duplicating; same as -id-strategy composite")
+	idStrategy       = flag.String("id-strategy", "", "how document IDs are made: none to leave them to the cluster, composite from date, location and status, hash of the -id-fields values, field for the value of the one -id-fields field, or uuid (default composite with -deterministic-ids, none otherwise)")
+	idFields         = flag.String("id-fields", "@timestamp,CountryCode,ProvinceCode,CityCode,Status", "comma separated fields used by -id-strategy hash and field")
+
+	workers          = flag.Int("workers", 10, "number of concurrent bulk upload workers")
+	clientsPerWorker = flag.Bool("clients-per-worker", false, "experimental: give every worker its own client and connection pool")
+	esURL            = flag.String("es-url", "http://localhost:9200", "comma separated addresses of the cluster; use https:// addresses with -es-client-cert")
+	esUsername       = flag.String("es-username", "", "username for HTTP basic authentication")
+	esPassword       = flag.String("es-password", "", "password for HTTP basic authentication; prefer -es-password-file, this shows up in process listings")
+	esPasswordFile   = flag.String("es-password-file", "", "file to read the basic authentication password from, overriding -es-password")
+	esAPIKey         = flag.String("es-api-key", "", "base64 encoded API key, overriding basic authentication; prefer -es-api-key-file")
+	esAPIKeyFile     = flag.String("es-api-key-file", "", "file to read the API key from, overriding -es-api-key")
+	traceHTTP        = flag.Bool("trace-http", false, "log every request to and response from elasticsearch, bodies truncated and credentials redacted")
+	esClientCert     = flag.String("es-client-cert", "", "PEM client certificate to present to the cluster, requires -es-client-key")
+	esClientKey      = flag.String("es-client-key", "", "PEM private key of -es-client-cert")
+
+	batchSize       = flag.Int("batch-size", 50, "number of records per bulk request")
+	adaptiveBatch   = flag.Bool("adaptive-batch", false, "grow the batch size while bulk requests succeed and back off on rejections or rising latency")
+	minBatchSize    = flag.Int("min-batch-size", 10, "smallest batch size used with -adaptive-batch")
+	maxBatchSize    = flag.Int("max-batch-size", 5000, "largest batch size used with -adaptive-batch")
+	maxBulkBytes    = flag.Int("max-bulk-bytes", 0, "also send a batch once its request body would exceed this many bytes (0 for no limit)")
+	refreshAfter    = flag.Bool("refresh-after", false, "refresh the indices written to once every batch is done, so the data is searchable as soon as the run ends")
+	maxRuntime      = flag.Duration("max-runtime", 0, "kill the run with exit status 4, logging the batches in flight and every goroutine's stack, if it is still going after this long (0 for no limit)")
+	streamBulk      = flag.Bool("stream-bulk", false, "stream each bulk request body to the cluster as it is encoded instead of buffering it; disables the client's retries, which need the whole body")
+	flushInterval   = flag.Duration("flush-interval", 0, "send a partial batch if this long passes without one filling up (0 to only flush full batches)")
+	workerWarmup    = flag.Duration("worker-warmup", 0, "delay between starting successive workers, e.g. 200ms")
+	logBatchesEvery = flag.Int("log-batches-every", 0, "log only every n-th batch, with a progress line summing up the batches in between (0 logs every batch)")
+	maxInflight     = flag.Int("max-inflight", 0, "maximum number of bulk requests in flight at once, independent of -workers (0 for no limit)")
+
+	indexName       = flag.String("index", "covid", "name of the index to write to")
+	indexPerStatus  = flag.Bool("index-per-status", false, "write each record to <index>-<status>, e.g. covid-confirmed")
+	maxPerIndex     = flag.Int("max-records-per-index", 0, "roll over to a new index, <index>-000001, <index>-000002 and so on, every this many records (0 to disable)")
+	opType          = flag.String("op-type", "index", "bulk action for each document: index overwrites existing documents, create leaves them be")
+	ignoreConflicts = flag.Bool("ignore-conflicts", false, "with -op-type create, count documents that already exist as conflicts instead of failures")
+	appendRunID     = flag.Bool("append-run-id", false, "stamp every document with a run_id generated for this run")
+	runID           = flag.String("run-id", "", "run_id to stamp every document with instead of a generated one; implies -append-run-id")
+	timestampMode   = flag.String("timestamp-mode", "source", "timestamp to index: source for the date in the record, ingest for the time of indexing, keeping the source date in event_date")
+	pipeline        = flag.String("pipeline", "", "ingest pipeline to pass every document through")
+	routingField    = flag.String("routing-field", "", "route each document by the value of this field, e.g. CountryCode")
+	createIndices   = flag.Bool("create-index", false, "create the target indices with the default mapping if they do not exist")
+	alias           = flag.String("alias", "", "write through this alias; with -create-index, -index is created as its write index")
+	forceAlias      = flag.Bool("force-alias", false, "move -alias to -index even if it already points at other indices")
+
+	otelEndpoint        = flag.String("otel-endpoint", "", "OTLP/HTTP collector to send trace spans of the run and each bulk request to, e.g. http://localhost:4318")
+	dryRunSampleSel     = flag.String("dry-run-sample", "", "print one record, chosen by its number or as field=value, after each stage of the pipeline, then exit without uploading")
+	sinkName            = flag.String("sink", "es", "where to send records: es to index them in elasticsearch, kafka to produce them to -kafka-topic")
+	backend             = flag.String("backend", "es", "cluster -sink es talks to: es for elasticsearch, opensearch for opensearch, which doesn't support -es-api-key")
+	kafkaBrokers        = flag.String("kafka-brokers", "localhost:9092", "comma separated kafka brokers for -sink kafka")
+	kafkaTopic          = flag.String("kafka-topic", "covid", "kafka topic for -sink kafka, one message per record")
+	explainOnly         = flag.Bool("explain", false, "print the index mapping and the bulk request body of the first batch, then exit without contacting elasticsearch")
+	listIndicesPattern  = flag.String("list-indices", "", "print the indices matching this pattern with their doc counts and sizes, then exit")
+	validateMappingOnly = flag.Bool("validate-mapping", false, "check that the mapping of the existing target index is compatible, then exit")
+)
+
+// fieldRenames is set by repeated -rename flags.
+var fieldRenames = make(renames)
+
+func init() {
+	flag.Var(fieldRenames, "rename", "index field `from` under a different name, as from=to or a JSON object of pairs; repeatable")
+}
+
 func main() {
-	var numUploaders int = 10
-	var batchSize int = 50
+	start := time.Now()
+	flag.Usage = usage
+	flag.Parse()
+	wd := startWatchdog(*maxRuntime)
+	logConfig()
+	if err := fieldRenames.validate(); err != nil {
+		log.Fatal("invalid -rename: ", err)
+	}
+	if *appendRunID && *runID == "" {
+		*runID = newUUID()
+	}
+	if *runID != "" {
+		log.Println("Run ID:", *runID)
+	}
 
-	points, err := readDatapoints("us.data", 100)
-	if err != nil {
+	if *listIndicesPattern != "" {
+		printIndices(*listIndicesPattern)
+		return
+	}
+	if *validateMappingOnly {
+		os.Exit(checkMapping())
+	}
+
+	up := newUploader()
+	p := &parser{
+		SkipBad:    *skipBadRecords,
+		MaxBad:     *maxBadRecords,
+		NoEnrich:   *noEnrich,
+		Workers:    *parseWorkers,
+		CacheSize:  *provinceCache,
+		OnMismatch: *onCodeMismatch,
+
+		CheckFuture:     *warnFuture || *dropFuture,
+		DropFuture:      *dropFuture,
+		FutureTolerance: *futureTolerance,
+		MaxAge:          *maxAge,
+		NormalizeSpace:  *normalizeWS,
+
+		OnRecordSkipped: up.recordSkipped,
+	}
+	switch p.OnMismatch {
+	case "blank", "keep", "fail":
+	default:
+		log.Fatalf("unknown -on-code-mismatch %q, expected blank, keep or fail", p.OnMismatch)
+	}
+	if *fieldMapFile != "" {
+		m, err := loadFieldMap(*fieldMapFile)
+		if err != nil {
+			log.Fatal("could not read field map: ", err)
+		}
+		p.Fields = m
+	}
+	if *printUnresolved {
+		p.Unresolved = make(map[string]int)
+	}
+	if *resolveCity != "" {
+		g, err := loadGazetteer(*resolveCity)
+		if err != nil {
+			log.Fatal("could not read gazetteer: ", err)
+		}
+		p.Gazetteer = g
+	}
+	if *overridesFile != "" || *overridesIndex != "" {
+		p.Overrides = make(map[string]string)
+		for k, v := range defaultOverrides {
+			p.Overrides[k] = v
+		}
+	}
+	if *overridesFile != "" {
+		m, err := loadOverridesFile(*overridesFile)
+		if err != nil {
+			log.Fatal("could not read overrides file: ", err)
+		}
+		for k, v := range m {
+			p.Overrides[k] = v
+		}
+	}
+	if *overridesIndex != "" {
+		oc, err := newClient()
+		if err != nil {
+			log.Fatal("could not create elasticsearch client: ", err)
+		}
+		m, err := loadOverridesIndex(oc, *overridesIndex)
+		if err != nil {
+			log.Fatal("could not load overrides index: ", err)
+		}
+		log.Printf("Loaded %d province overrides from %s", len(m), *overridesIndex)
+		for k, v := range m {
+			p.Overrides[k] = v
+		}
+	}
+
+	if *explainOnly {
+		explain(p)
+		return
+	}
+	if *dryRunSampleSel != "" {
+		dryRunSample(p, *dryRunSampleSel)
+		return
+	}
+
+	ctx, endTrace := startTrace()
+	defer endTrace(nil)
+
+	// finish exits with exitThresholds if s, with the malformed records the
+	// parser skipped, breaks -max-error-rate or -max-skip-rate. Only a run that
+	// stays within them and has no failed documents moves the -since-file
+	// marker, so that the files of the others are read again next time.
+	finish := func(s *summary) {
+		s.Skipped += p.malformed()
+		code := checkQuality(s)
+		if code == exitOK && s.Failed == 0 {
+			updateMarker(start)
+		}
+		if code != exitOK {
+			endTrace(nil)
+			os.Exit(code)
+		}
+	}
+
+	l := newLoader(up)
+	l.ctx = ctx
+	wd.watch(l.up)
+
+	// Records are uploaded as soon as they are read and checked, unless a
+	// transform needs every record, or with -max-memory a chunk of them, at
+	// hand first.
+	var total int
+	var err, loadErr error
+	switch {
+	case !needsAllRecords():
+		err = readInput(p, func(d datapoint) error {
+			total++
+			return l.send(l.check([]datapoint{d}))
+		})
+		l.report()
+		loadErr = l.wait()
+	case *maxMemory > 0:
+		n := chunkSize(*maxMemory)
+		log.Printf("Loading in chunks of at most %d records", n)
+		if *sortPoints || *casesDelta || hasIDs() {
+			log.Println("Warning: with -max-memory, -sort, -cases-delta and duplicate ID detection only apply within each chunk")
+		}
+		var chunk []datapoint
+		err = readInput(p, func(d datapoint) error {
+			chunk = append(chunk, d)
+			total++
+			if len(chunk) == n {
+				// The pool keeps sending the end of this chunk while the
+				// next one is read.
+				if err := l.send(l.prepare(chunk)); err != nil {
+					return err
+				}
+				chunk = nil
+			}
+			return nil
+		})
+		if err == nil {
+			l.send(l.prepare(chunk))
+		}
+		loadErr = l.wait()
+	default:
+		var points []datapoint
+		err = readInput(p, func(d datapoint) error {
+			points = append(points, d)
+			return nil
+		})
+		total = len(points)
+		if err == nil {
+			loadErr = l.load(l.prepare(points))
+		}
+	}
+	if err != nil && err != errStop {
 		log.Fatal("could not read file", err)
 	}
+	l.close()
+	reportParser(p)
+	if total == 0 {
+		log.Println("No records to index")
+		finish(l.summary)
+		return
+	}
+	if loadErr != nil {
+		l.summary.print()
+		endTrace(loadErr)
+		log.Fatal("Stopping on first bulk error: ", loadErr)
+	}
+	if *refreshAfter {
+		l.refresh()
+	}
+	l.summary.print()
+	finish(l.summary)
 
-	numBatches := int(math.Ceil(float64(len(points) / batchSize)))
-	log.Println("Number of records:", len(points))
-	log.Println("Number of batches:", numBatches)
+	// uploadPoints(ec, &points, "covid")
+
+}
 
-	ec, err := elasticsearch.NewClient(elasticsearch.Config{
-		Addresses: []string{
-			"http://localhost:9200",
-		},
+// needsAllRecords reports whether the run transforms or checks its records
+// as a set, so they cannot be uploaded as they are read: -sort, -cases-delta,
+// duplicate ID detection and the all or nothing checks of -strict.
+func needsAllRecords() bool {
+	return *sortPoints || *casesDelta || hasIDs() || *strict
+}
+
+// readInput decodes -input, calling fn for every record up to -limit of them.
+// With several input files up to -input-workers of them are read at once; fn
+// sees their records interleaved but is never called concurrently.
+func readInput(p *parser, fn func(datapoint) error) error {
+	if *limit > 0 {
+		next, n := fn, 0
+		fn = func(d datapoint) error {
+			if err := next(d); err != nil {
+				return err
+			}
+			if n++; n == *limit {
+				return errLimit
+			}
+			return nil
+		}
+	}
+	err := readAll(p, fn)
+	if errors.Is(err, errLimit) {
+		return nil
+	}
+	return err
+}
+
+// errLimit ends reading once -limit records have been read.
+var errLimit = errors.New("limit reached")
+
+func readAll(p *parser, fn func(datapoint) error) error {
+	if *input == "-" {
+		return streamRecords(p, os.Stdin, fn)
+	}
+
+	var since time.Time
+	if *sinceFile != "" {
+		var err error
+		if since, err = readMarker(*sinceFile); err != nil {
+			return err
+		}
+	}
+	files, err := inputFiles(*input, since)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		log.Printf("No files in %s modified since %s", *input, since.Format(time.RFC3339))
+	}
+	if len(files) == 1 {
+		return readFile(p, files[0], fn)
+	}
+
+	// Each file is read by a goroutine of its own, up to -input-workers of
+	// them at once, into a single stream that fn takes records from as they
+	// arrive, so uploads carry on across file boundaries.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	merged := make(chan datapoint)
+	readErrs := make(chan error, len(files))
+	go func() {
+		defer close(merged)
+		n := *inputWorkers
+		if n < 1 {
+			n = 1
+		}
+		sem := make(chan struct{}, n)
+		var wg sync.WaitGroup
+	files:
+		for _, name := range files {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				break files
+			}
+			wg.Add(1)
+			go func(name string) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				err := readFile(p, name, func(d datapoint) error {
+					select {
+					case merged <- d:
+						return nil
+					case <-ctx.Done():
+						return errStop
+					}
+				})
+				if err != nil && err != errStop {
+					readErrs <- fmt.Errorf("%s: %w", name, err)
+					cancel()
+				}
+			}(name)
+		}
+		wg.Wait()
+	}()
+
+	// Once fn or a file fails, the records still arriving are dropped.
+	for d := range merged {
+		if err == nil && ctx.Err() == nil {
+			if err = fn(d); err != nil {
+				cancel()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-readErrs:
+	default:
+	}
+	return err
+}
+
+// readFile decodes the file name, tagging every record with it as its source.
+func readFile(p *parser, name string, fn func(datapoint) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	log.Println("Reading", name)
+	var n int
+	err = streamRecords(p, f, func(d datapoint) error {
+		d.Source = name
+		n++
+		return fn(d)
 	})
+	log.Printf("Read %d records from %s", n, name)
+	return err
+}
+
+// streamRecords decodes r like parser.decode, but parses and enriches it in
+// the background, so that the next records are ready by the time fn, which
+// feeds the upload, returns.
+func streamRecords(p *parser, r io.Reader, fn func(datapoint) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	points, errc := p.streamDatapoints(ctx, r)
+	for d := range points {
+		if err := fn(d); err != nil {
+			cancel()
+			for range points {
+			}
+			<-errc
+			return err
+		}
+	}
+	return <-errc
+}
+
+// updateMarker records start in the -since-file marker, if one is used.
+// Recording the start rather than the end of the run means files modified
+// while it was running are picked up again next time.
+func updateMarker(start time.Time) {
+	if *sinceFile == "" {
+		return
+	}
+	if err := writeMarker(*sinceFile, start); err != nil {
+		log.Fatal("could not update marker: ", err)
+	}
+}
+
+// reportParser logs what the parser skipped or couldn't resolve, and with
+// -print-unresolved prints the unresolved provinces. It is called as soon as
+// the input is read, before the run can end in os.Exit or log.Fatal, which
+// skip deferred calls.
+func reportParser(p *parser) {
+	if p.Skipped > 0 {
+		log.Println("Skipped bad records:", p.Skipped)
+	}
+	if p.Future > 0 {
+		if p.DropFuture {
+			log.Println("Dropped records dated in the future:", p.Future)
+		} else {
+			log.Println("Warning: records dated in the future:", p.Future)
+		}
+	}
+	if p.TooOld > 0 {
+		log.Printf("Dropped records older than %s: %d", p.MaxAge, p.TooOld)
+	}
+	if p.Mismatches > 0 {
+		log.Println("Province codes not matching their country:", p.Mismatches)
+	}
+	if p.CityMisses > 0 {
+		log.Println("Cities not found in gazetteer:", p.CityMisses)
+	}
+	if p.Unresolved != nil {
+		printUnresolvedProvinces(p)
+	}
+}
+
+// newLoader connects up to the cluster and sets up the target indices, or
+// with -sink kafka sets up the producer instead.
+func newLoader(up *Uploader) *loader {
+	switch *sinkName {
+	case "es":
+	case "kafka":
+		brokers := splitList(*kafkaBrokers)
+		log.Printf("Producing to kafka topic %s on %s", *kafkaTopic, strings.Join(brokers, ", "))
+		return &loader{
+			up:      up,
+			sink:    newKafkaSink(up, brokers, *kafkaTopic),
+			summary: newSummary(),
+			created: make(map[string]bool),
+		}
+	default:
+		log.Fatalf("unknown -sink %q, expected es or kafka", *sinkName)
+	}
+
+	ec, err := newClient()
 	if err != nil {
-		log.Fatal("could not create elasticsearch client", err)
+		log.Fatal("could not create elasticsearch client: ", err)
 	}
 
-	res, err := ec.Info()
+	res, err := esapi.InfoRequest{}.Do(context.Background(), ec)
 	if err != nil {
 		log.Fatal("could not get cluster info", err)
 	}
@@ -53,135 +562,347 @@ func main() {
 	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
 		log.Fatalf("Error parsing the response body: %s", err)
 	}
-	// Print client and server version numbers.
-	log.Printf("ES Client: %s", elasticsearch.Version)
-	log.Printf("ES Server: %s", r["version"].(map[string]interface{})["number"])
+	// Print client and server version numbers. OpenSearch reports its own
+	// version numbers, so they are not comparable with Elasticsearch's.
+	if *backend == "opensearch" {
+		log.Printf("OpenSearch Client: %s", opensearch.Version)
+		log.Printf("OpenSearch Server: %s", r["version"].(map[string]interface{})["number"])
+	} else {
+		log.Printf("ES Client: %s", elasticsearch.Version)
+		log.Printf("ES Server: %s", r["version"].(map[string]interface{})["number"])
+	}
 	log.Println(strings.Repeat("-", 30))
 
-	q := make(chan batch)
-	done := make(chan bool)
+	up.Client = ec
 
-	// Initialize workers
-	for i := 0; i < numUploaders; i++ {
-		log.Println("Initializing worker", i)
-		go bulkUploader(q, i, ec, done)
+	if up.Pipeline != "" {
+		ok, err := pipelineExists(ec, up.Pipeline)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			log.Printf("Warning: ingest pipeline %s does not exist, indexing without it", up.Pipeline)
+			up.Pipeline = ""
+		}
 	}
 
-	var payload []datapoint
-	var currBatch = 1
-
-	for i, e := range points {
-		payload = append(payload, e)
-		if (i+1)%batchSize == 0 || i+1 == len(points) {
-			log.Printf("Sending batch %d to queue", currBatch)
-			go func(b batch) {
-				q <- b
-			}(batch{ID: currBatch, Payload: payload})
-			currBatch++
-			payload = nil
+	mapping, err := renamedMapping(fieldRenames)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var roll *rollover
+	if *maxPerIndex > 0 {
+		if *alias != "" {
+			log.Fatal("-alias cannot be combined with -max-records-per-index")
 		}
+		roll = newRollover(*maxPerIndex)
 	}
-
-	for c := 0; c < (numBatches); c++ {
-		<-done
+	if *alias != "" && *createIndices {
+		if err := setupWriteAlias(ec, *indexName, *alias, mapping, *forceAlias); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	// uploadPoints(ec, &points, "covid")
+	return &loader{
+		up:       up,
+		sink:     up,
+		mapping:  mapping,
+		rollover: roll,
+		summary:  newSummary(),
+		created:  make(map[string]bool),
+	}
+}
 
+// newUploader returns an Uploader configured from the command line, without
+// a client.
+func newUploader() *Uploader {
+	up := &Uploader{
+		Workers:         *workers,
+		Index:           *indexName,
+		IndexPerStatus:  *indexPerStatus,
+		RoutingField:    *routingField,
+		Pipeline:        *pipeline,
+		OpType:          *opType,
+		IgnoreConflicts: *ignoreConflicts,
+		TimestampMode:   *timestampMode,
+		RunID:           *runID,
+		VersionField:    *versionField,
+		Renames:         fieldRenames,
+		Stream:          *streamBulk,
+		MaxInflight:     *maxInflight,
+		LogEvery:        *logBatchesEvery,
+		BatchSize:       *batchSize,
+		Warmup:          *workerWarmup,
+	}
+	if *clientsPerWorker {
+		up.NewClient = newClient
+	}
+	ids, err := newIDGenerator(idStrategyName(), splitList(*idFields))
+	if err != nil {
+		log.Fatal(err)
+	}
+	up.IDs = ids
+	if up.OpType != "index" && up.OpType != "create" {
+		log.Fatalf("unknown -op-type %q, expected index or create", up.OpType)
+	}
+	if up.TimestampMode != "source" && up.TimestampMode != "ingest" {
+		log.Fatalf("unknown -timestamp-mode %q, expected source or ingest", up.TimestampMode)
+	}
+	if up.VersionField != "" {
+		if _, ok := versionOf(datapoint{}, up.VersionField); !ok {
+			log.Fatalf("-external-version-field %q is not a timestamp or integer field", up.VersionField)
+		}
+		if !stableIDs(up.IDs) {
+			log.Fatal("-external-version-field requires -deterministic-ids or an -id-strategy other than none or uuid")
+		}
+		if up.OpType == "create" {
+			log.Fatal("-external-version-field cannot be combined with -op-type create")
+		}
+	}
+	if up.RoutingField != "" {
+		if err := checkField(up.RoutingField); err != nil {
+			log.Fatal("-routing-field: ", err)
+		}
+	}
+	if *alias != "" {
+		if up.IndexPerStatus {
+			log.Fatal("-alias cannot be combined with -index-per-status")
+		}
+		up.Index = *alias
+	}
+	return up
 }
 
-type datapoint struct {
-	// ID           string    `json:"id"`
-	Ts           time.Time `json:"@timestamp"`
-	CountryName  string    `json:"country_name"`
-	CountryCode  string    `json:"country_code"`
-	Province     string    `json:"province"`
-	ProvinceCode string    `json:"province_code"`
-	City         string    `json:"city"`
-	CityCode     string    `json:"city_code"`
-	Geo          geo       `json:"geo"`
-	Cases        int       `json:"cases"`
-	Status       string    `json:"status"`
+// printIndices prints the indices matching pattern as a table.
+func printIndices(pattern string) {
+	ec, err := newClient()
+	if err != nil {
+		log.Fatal("could not create elasticsearch client: ", err)
+	}
+	idx, err := listIndices(ec, pattern)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(idx) == 0 {
+		log.Printf("No indices match %s", pattern)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tDOCS\tSIZE")
+	for _, i := range idx {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", i.Index, i.DocsCount, i.StoreSize)
+	}
+	w.Flush()
 }
 
-type geo struct {
-	Lat  float64 `json:"lat"`
-	Long float64 `json:"lon"`
+// printUnresolvedProvinces prints the province names that didn't resolve to
+// a subdivision code, with the number of records naming each, as a table.
+func printUnresolvedProvinces(p *parser) {
+	if len(p.Unresolved) == 0 {
+		log.Println("All provinces resolved")
+		return
+	}
+	var names []string
+	for name := range p.Unresolved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	log.Printf("%d province names did not resolve:", len(names))
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROVINCE	RECORDS")
+	for _, name := range names {
+		fmt.Fprintf(w, "%q\t%d\n", name, p.Unresolved[name])
+	}
+	w.Flush()
 }
 
-func (d *datapoint) UnmarshalJSON(b []byte) error {
-	var s map[string]interface{}
+// checkMapping validates the mapping of the target index and returns the
+// process exit code: 0 if it is compatible, 1 if not.
+func checkMapping() int {
+	target := *indexName
+	if *alias != "" {
+		target = *alias
+	} else if *indexPerStatus {
+		target = *indexName + "-*"
+	}
 
-	err := json.Unmarshal(b, &s)
+	ec, err := newClient()
 	if err != nil {
-		return err
+		log.Fatal("could not create elasticsearch client: ", err)
 	}
-	d.Ts, err = time.Parse(time.RFC3339, s["Date"].(string))
+	mapping, err := renamedMapping(fieldRenames)
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-	d.CountryName = s["Country"].(string)
-	d.CountryCode = s["CountryCode"].(string)
-	d.Province = s["Province"].(string)
-
-	if _, ok := s["City"]; ok {
-		d.City = s["City"].(string)
+	problems, warnings, err := validateMapping(ec, target, mapping, unwrittenFields())
+	if err != nil {
+		log.Fatal(err)
 	}
-	if _, ok := s["CityCode"]; ok {
-		d.CityCode = s["CityCode"].(string)
+	for _, w := range warnings {
+		log.Println("Warning:", w)
 	}
-	d.Geo.Lat, err = strconv.ParseFloat(s["Lat"].(string), 64)
-	if err != nil {
-		return err
+	for _, p := range problems {
+		log.Println("Incompatible mapping:", p)
 	}
-	d.Geo.Long, err = strconv.ParseFloat(s["Lon"].(string), 64)
-	if err != nil {
-		return err
+	if len(problems) > 0 {
+		return 1
+	}
+	log.Printf("Mapping of %s is compatible", target)
+	return 0
+}
+
+// unwrittenFields returns the indexed names of the optional fields this run
+// leaves out of every document.
+func unwrittenFields() map[string]bool {
+	unwritten := make(map[string]bool)
+	if *timestampMode != "ingest" {
+		unwritten[fieldRenames.name("event_date")] = true
+	}
+	if !*casesDelta {
+		unwritten[fieldRenames.name("cases_delta")] = true
+	}
+	if *runID == "" {
+		unwritten[fieldRenames.name("run_id")] = true
 	}
-	d.Cases = int(s["Cases"].(float64))
-	d.Status = s["Status"].(string)
+	return unwritten
+}
 
-	return nil
+type datapoint struct {
+	ID           string     `json:"-"`
+	Index        string     `json:"-"`
+	Source       string     `json:"-"`
+	Ts           time.Time  `json:"@timestamp"`
+	EventDate    *time.Time `json:"event_date,omitempty"`
+	CountryName  string     `json:"country_name"`
+	CountryCode  string     `json:"country_code"`
+	Province     string     `json:"province"`
+	ProvinceCode string     `json:"province_code"`
+	City         string     `json:"city"`
+	CityCode     string     `json:"city_code"`
+	Geo          geo        `json:"geo"`
+	Cases        int        `json:"cases"`
+	CasesDelta   *int       `json:"cases_delta,omitempty"`
+	Status       string     `json:"status"`
+	RunID        string     `json:"run_id,omitempty"`
 }
 
-func readDatapoints(f string, n int) ([]datapoint, error) {
-	data, err := ioutil.ReadFile(f)
-	if err != nil {
-		return nil, err
+// fieldValue returns the value of the datapoint field called name, matching
+// either the Go field name ("CountryCode") or its JSON name ("country_code").
+// Optional fields that are unset give "". ok is false when no such field
+// exists or it holds more than a single value, like geo.
+func fieldValue(d datapoint, name string) (v string, ok bool) {
+	i, found := fieldIndex(name)
+	if !found {
+		return "", false
+	}
+	fv := reflect.ValueOf(d).Field(i)
+	if fv.Kind() == reflect.Ptr {
+		if fv.IsNil() {
+			return "", scalarType(fv.Type().Elem())
+		}
+		fv = fv.Elem()
+	}
+	if !scalarType(fv.Type()) {
+		return "", false
 	}
+	if t, ok := fv.Interface().(time.Time); ok {
+		return t.Format(time.RFC3339), true
+	}
+	return fmt.Sprint(fv.Interface()), true
+}
 
-	var points []datapoint
-	err = json.Unmarshal(data, &points)
-	if err != nil {
-		return nil, err
+// fieldIndex returns the index of the datapoint field called name, matched
+// like fieldValue.
+func fieldIndex(name string) (int, bool) {
+	rt := reflect.TypeOf(datapoint{})
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Name == name || (tag == name && tag != "-") {
+			return i, true
+		}
 	}
+	return 0, false
+}
 
-	query := gountries.New()
-	us, err := query.FindCountryByAlpha("US")
-	if err != nil {
-		return nil, err
+// scalarType reports whether values of t are strings, numbers, booleans or
+// timestamps.
+func scalarType(t reflect.Type) bool {
+	if t == reflect.TypeOf(time.Time{}) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
 	}
+	return false
+}
 
-	for i := 0; i < len(points); i++ {
-		if points[i].Province == "Virgin Islands" {
-			points[i].ProvinceCode = "US-VI"
-		} else if points[i].Province == "Grand Princess" {
-			points[i].ProvinceCode = ""
-		} else if points[i].Province == "Diamond Princess" {
-			points[i].ProvinceCode = ""
-		} else {
-			pCode, err := us.FindSubdivisionByName(points[i].Province)
-			if err != nil {
-				return nil, err
-			}
+// checkField returns an error unless name is a datapoint field fieldValue
+// can read, distinguishing unknown fields from those holding several values.
+func checkField(name string) error {
+	if _, ok := fieldIndex(name); !ok {
+		return fmt.Errorf("unknown field %q", name)
+	}
+	if _, ok := fieldValue(datapoint{}, name); !ok {
+		return fmt.Errorf("field %q holds more than a single value", name)
+	}
+	return nil
+}
 
-			points[i].ProvinceCode = "US-" + pCode.Code
+// versionOf returns the value of the datapoint field called name as a
+// document version, matching like fieldValue. ok is false unless the field is
+// a timestamp, which gives its milliseconds since the epoch, or an integer.
+func versionOf(d datapoint, name string) (v int64, ok bool) {
+	rv := reflect.ValueOf(d)
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Name != name && tag != name {
+			continue
+		}
+		switch x := rv.Field(i).Interface().(type) {
+		case time.Time:
+			return x.UnixNano() / int64(time.Millisecond), true
+		case int:
+			return int64(x), true
 		}
+		return 0, false
+	}
+	return 0, false
+}
+
+type geo struct {
+	Lat  float64 `json:"lat"`
+	Long float64 `json:"lon"`
+}
 
-		// assignID(&points[i])
+// UnmarshalJSON parses a record laid out like the original source data.
+func (d *datapoint) UnmarshalJSON(b []byte) error {
+	return defaultFields.unmarshal(b, d)
+}
+
+// stringField returns s[k] if it holds a string, and an error otherwise.
+func stringField(s map[string]interface{}, k string) (string, error) {
+	v, ok := s[k].(string)
+	if !ok {
+		return "", fmt.Errorf("field %q: expected a string, got %T", k, s[k])
 	}
+	return v, nil
+}
 
-	return points, nil
+// sortByTimestamp orders points by Ts, keeping the source order of records
+// that share a timestamp.
+func sortByTimestamp(points []datapoint) {
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Ts.Before(points[j].Ts)
+	})
 }
 
 func uploadPoints(ec *elasticsearch.Client, p *[]datapoint, idx string) (int, error) {
@@ -207,65 +928,44 @@ func uploadPoints(ec *elasticsearch.Client, p *[]datapoint, idx string) (int, er
 	return count, nil
 }
 
-type batch struct {
-	Payload []datapoint
-	ID      int
+// formatBytes renders n using binary units, e.g. 1536 as "1.5 KiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
-func bulkUploader(queue chan batch, wid int, ec *elasticsearch.Client, done chan bool) {
-	var buf bytes.Buffer
-	var raw map[string]interface{}
-	for {
-		batch := <-queue
-		for _, e := range batch.Payload {
-			meta := []byte(fmt.Sprintf(`{ "index" : { "_index": "covid" } }%s`, "\n"))
-			data, err := json.Marshal(e)
-			if err != nil {
-				log.Printf("Worker %d: could not marshal json: %v ... skipping", wid, err)
-				continue
-			}
-			data = append(data, "\n"...)
-
-			buf.Grow(len(meta) + len(data))
-			buf.Write(meta)
-			buf.Write(data)
-		}
-		log.Printf("Uploading batch %d of %d records\n", batch.ID, len(batch.Payload))
+type countryCount struct {
+	Code  string
+	Count int
+}
 
-		res, err := ec.Bulk(bytes.NewReader(buf.Bytes()), ec.Bulk.WithIndex("covid"))
-		if err != nil {
-			log.Printf("Failure indexing batch %d: %s", batch.ID, err)
-			done <- true
-			continue
-		}
-		defer res.Body.Close()
-
-		if res.IsError() {
-			if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
-				log.Printf("Failure to to parse response body: %s", err)
-				done <- true
-				continue
-			} else {
-				log.Printf("  Error: [%d] %s: %s",
-					res.StatusCode,
-					raw["error"].(map[string]interface{})["type"],
-					raw["error"].(map[string]interface{})["reason"],
-				)
-				done <- true
-				continue
-			}
+// topCountries returns the n countries with the most documents, largest first.
+func topCountries(m map[string]int, n int) []countryCount {
+	var cc []countryCount
+	for k, v := range m {
+		cc = append(cc, countryCount{Code: k, Count: v})
+	}
+	sort.Slice(cc, func(i, j int) bool {
+		if cc[i].Count == cc[j].Count {
+			return cc[i].Code < cc[j].Code
 		}
-		buf.Reset()
-		done <- true
+		return cc[i].Count > cc[j].Count
+	})
+	if len(cc) > n {
+		cc = cc[:n]
 	}
+	return cc
 }
 
 func timeTaken(t time.Time, n int) {
 	elapsed := time.Since(t)
 	log.Printf("Num uploaders: %d\t\t%s\n", n, elapsed)
 }
-
-func assignID(d *datapoint) error {
-	// d.ID = fmt.Sprintf("%d%d%d-%s-%s-%s\n", d.Ts.Year(), d.Ts.Month(), d.Ts.Day(), d.CountryCode, d.ProvinceCode, d.CityCode)
-	return nil
-}
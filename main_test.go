@@ -0,0 +1,249 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain keeps the progress the code under test logs out of the test
+// output unless it runs with -v.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+func TestSortByTimestamp(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2020, 3, d, 0, 0, 0, 0, time.UTC) }
+	points := []datapoint{
+		{Ts: day(3), Province: "a"},
+		{Ts: day(1), Province: "b"},
+		{Ts: day(2), Province: "c"},
+		{Ts: day(1), Province: "d"},
+		{Ts: day(3), Province: "e"},
+		{Ts: day(1), Province: "f"},
+	}
+	sortByTimestamp(points)
+
+	// Records sharing a timestamp keep their source order.
+	want := []string{"b", "d", "f", "c", "a", "e"}
+	for i, p := range points {
+		if p.Province != want[i] {
+			t.Fatalf("order = %v, want %v", provinces(points), want)
+		}
+		if i > 0 && p.Ts.Before(points[i-1].Ts) {
+			t.Fatalf("record %d (%s) is before record %d", i, p.Ts, i-1)
+		}
+	}
+}
+
+func provinces(points []datapoint) []string {
+	var names []string
+	for _, p := range points {
+		names = append(names, p.Province)
+	}
+	return names
+}
+
+func TestReadFileEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "covid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"empty":      "",
+		"whitespace": " \n\t\n",
+		"array":      "[]",
+		"spaced":     "[ \n ]\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := filepath.Join(dir, name+".json")
+			if err := ioutil.WriteFile(f, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var n int
+			if err := readFile(&parser{}, f, func(datapoint) error { n++; return nil }); err != nil {
+				t.Fatalf("err = %v, want none", err)
+			}
+			if n != 0 {
+				t.Errorf("read %d records, want 0", n)
+			}
+		})
+	}
+}
+
+func TestReadInputLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "covid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.json", "b.json"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(records(10)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(in string, n int) { *input, *limit = in, n }(*input, *limit)
+	for _, tc := range []struct {
+		input       string
+		limit, want int
+	}{
+		{"a.json", 3000, 10},
+		{"a.json", 10, 10},
+		{"a.json", 3, 3},
+		{"a.json", 0, 10},
+		{"*.json", 3000, 20},
+		{"*.json", 15, 15},
+	} {
+		*input, *limit = filepath.Join(dir, tc.input), tc.limit
+		var n int
+		if err := readInput(&parser{}, func(datapoint) error { n++; return nil }); err != nil {
+			t.Errorf("%s with -limit %d: err = %v, want none", tc.input, tc.limit, err)
+		}
+		if n != tc.want {
+			t.Errorf("%s with -limit %d: read %d records, want %d", tc.input, tc.limit, n, tc.want)
+		}
+	}
+}
+
+func TestFieldValue(t *testing.T) {
+	ts := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	delta := -3
+	d := datapoint{Ts: ts, EventDate: &ts, CasesDelta: &delta, Cases: 7, CountryCode: "US", Geo: geo{Lat: 1, Long: 2}}
+	for _, tc := range []struct {
+		d     datapoint
+		field string
+		want  string
+		ok    bool
+	}{
+		{d, "CountryCode", "US", true},
+		{d, "country_code", "US", true},
+		{d, "cases", "7", true},
+		{d, "@timestamp", "2020-04-01T00:00:00Z", true},
+		{d, "cases_delta", "-3", true},
+		{d, "event_date", "2020-04-01T00:00:00Z", true},
+		{datapoint{}, "cases_delta", "", true},
+		{datapoint{}, "EventDate", "", true},
+		{d, "geo", "", false},
+		{d, "Colour", "", false},
+		{d, "-", "", false},
+	} {
+		v, ok := fieldValue(tc.d, tc.field)
+		if v != tc.want || ok != tc.ok {
+			t.Errorf("%s: got %q, %v; want %q, %v", tc.field, v, ok, tc.want, tc.ok)
+		}
+	}
+
+	if err := checkField("cases_delta"); err != nil {
+		t.Errorf("cases_delta: %v", err)
+	}
+	if err := checkField("geo"); err == nil || !strings.Contains(err.Error(), "more than a single value") {
+		t.Errorf("geo: err = %v, want it rejected as holding several values", err)
+	}
+	if err := checkField("Colour"); err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Errorf("Colour: err = %v, want it rejected as unknown", err)
+	}
+}
+
+func TestStreamRecordsUploadsWhileReading(t *testing.T) {
+	defer func(size int) { *batchSize = size }(*batchSize)
+	*batchSize = 10
+
+	started := make(chan struct{}, 2)
+	es := &fakeES{Started: started}
+	up := &Uploader{Client: es, Workers: 1, Index: "covid"}
+	l := &loader{up: up, sink: up, summary: newSummary(), created: make(map[string]bool)}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- streamRecords(&parser{}, pr, func(d datapoint) error {
+			return l.send(l.check([]datapoint{d}))
+		})
+	}()
+
+	// A full batch goes out while the rest of the input is still to come.
+	io.WriteString(pw, records(10))
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing uploaded before the input ended")
+	}
+	io.WriteString(pw, records(5))
+	pw.Close()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := l.wait(); err != nil {
+		t.Fatal(err)
+	}
+	if l.summary.Indexed != 15 {
+		t.Errorf("indexed %d records, want 15", l.summary.Indexed)
+	}
+}
+
+func TestReadInputUploadsAcrossFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "covid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.json", "b.json", "c.json"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(records(20)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(in string, n, size int) { *input, *inputWorkers, *batchSize = in, n, size }(*input, *inputWorkers, *batchSize)
+	*input, *inputWorkers, *batchSize = filepath.Join(dir, "*.json"), 2, 5
+
+	// Every request stalls until the test takes it, so the input can only
+	// be read in full if nothing waits on uploads.
+	started := make(chan struct{})
+	es := &fakeES{Started: started}
+	up := &Uploader{Client: es, Workers: 1, Index: "covid"}
+	l := &loader{up: up, sink: up, summary: newSummary(), created: make(map[string]bool)}
+	done := make(chan error, 1)
+	go func() {
+		done <- readInput(&parser{}, func(d datapoint) error {
+			return l.send(l.check([]datapoint{d}))
+		})
+	}()
+
+	select {
+	case <-started:
+	case err := <-done:
+		t.Fatalf("input read in full (err = %v) before the first upload", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing uploaded")
+	}
+	go func() {
+		for range started {
+		}
+	}()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := l.wait(); err != nil {
+		t.Fatal(err)
+	}
+	close(started)
+	s := l.summary
+	if s.Indexed != 60 || len(s.Files) != 3 {
+		t.Errorf("indexed %d records from %d files, want 60 from 3", s.Indexed, len(s.Files))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+// defaultOverrides maps province names gountries can't resolve to the
+// province code they should be indexed with. An empty code means the record
+// has no province code, e.g. for cruise ships.
+var defaultOverrides = map[string]string{
+	"Virgin Islands":   "US-VI",
+	"Grand Princess":   "",
+	"Diamond Princess": "",
+}
+
+// loadOverridesFile reads province overrides from a JSON object mapping
+// province names to codes, e.g. {"Virgin Islands": "US-VI"}.
+func loadOverridesFile(f string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]string
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", f, err)
+	}
+	return m, nil
+}
+
+// overrideDoc is a province override stored as a document in Elasticsearch.
+type overrideDoc struct {
+	Province     string `json:"province"`
+	ProvinceCode string `json:"province_code"`
+}
+
+type scrollResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []struct {
+			Source json.RawMessage `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// loadOverridesIndex reads every document in index as an overrideDoc and
+// returns the resulting province overrides.
+func loadOverridesIndex(t esapi.Transport, index string) (map[string]string, error) {
+	const scroll = time.Minute
+	ctx := context.Background()
+
+	res, err := esapi.SearchRequest{
+		Index:  []string{index},
+		Body:   strings.NewReader(`{"query":{"match_all":{}}}`),
+		Size:   esapi.IntPtr(1000),
+		Scroll: scroll,
+	}.Do(ctx, t)
+
+	m := make(map[string]string)
+	var scrollID string
+	for {
+		if err != nil {
+			return nil, err
+		}
+		var sr scrollResponse
+		if res.IsError() {
+			err = fmt.Errorf("could not search %s: %s", index, res.String())
+		} else {
+			err = json.NewDecoder(res.Body).Decode(&sr)
+		}
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		scrollID = sr.ScrollID
+		if len(sr.Hits.Hits) == 0 {
+			break
+		}
+		for _, h := range sr.Hits.Hits {
+			var o overrideDoc
+			if err := json.Unmarshal(h.Source, &o); err != nil {
+				return nil, err
+			}
+			if o.Province != "" {
+				m[o.Province] = o.ProvinceCode
+			}
+		}
+
+		res, err = esapi.ScrollRequest{ScrollID: scrollID, Scroll: scroll}.Do(ctx, t)
+	}
+
+	if scrollID != "" {
+		if res, err := (esapi.ClearScrollRequest{ScrollID: []string{scrollID}}).Do(ctx, t); err == nil {
+			res.Body.Close()
+		}
+	}
+	return m, nil
+}
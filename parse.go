@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pariz/gountries"
+)
+
+// parser turns source data into enriched datapoints. Input is either a JSON
+// array of records or newline delimited JSON objects. By default a single
+// malformed record fails the whole input; with SkipBad set such records are
+// logged and skipped until more than MaxBad of them have been seen (MaxBad <= 0
+// means no limit).
+type parser struct {
+	SkipBad bool
+	MaxBad  int
+
+	// Fields maps datapoint fields to source keys. defaultFields is used
+	// when it is nil.
+	Fields fieldMap
+
+	// NormalizeSpace trims the string fields of every record and collapses
+	// each run of whitespace inside them, non-breaking spaces included, into
+	// a single space, so names padded or spaced differently in the source
+	// still resolve and aggregate together.
+	NormalizeSpace bool
+
+	// NoEnrich skips province code resolution, leaving ProvinceCode as it was
+	// in the source.
+	NoEnrich bool
+
+	// Overrides maps province names to the province code to use instead of
+	// looking them up. defaultOverrides is used when it is nil.
+	Overrides map[string]string
+
+	// Gazetteer, if set, is used to fill in CityCode for records that have a
+	// City but no CityCode. CityMisses counts the cities it didn't know.
+	Gazetteer  gazetteer
+	CityMisses int
+
+	// CacheSize caps how many resolved province codes are cached per
+	// country. Provinces repeat across most records, so even a small cache
+	// saves nearly all subdivision lookups. Zero disables caching.
+	CacheSize int
+
+	// Unresolved, if non-nil, counts the province names that matched no
+	// subdivision. Their records are kept with an empty ProvinceCode instead
+	// of failing.
+	Unresolved map[string]int
+
+	// CheckFuture counts the records dated more than FutureTolerance after
+	// the time they are parsed in Future. With DropFuture they are also
+	// skipped.
+	CheckFuture     bool
+	DropFuture      bool
+	FutureTolerance time.Duration
+	Future          int
+
+	// MaxAge, if positive, drops the records dated more than MaxAge before
+	// the time they are parsed, counting them in TooOld.
+	MaxAge time.Duration
+	TooOld int
+
+	// OnMismatch decides what happens to a province code whose country
+	// prefix differs from the record's CountryCode, as can happen with an
+	// override meant for another country: "blank" (the default) clears it,
+	// "keep" keeps it and "fail" fails the record. Either way Mismatches
+	// counts them and the first of each province and country is logged.
+	OnMismatch string
+	Mismatches int
+
+	// Workers is the number of records parsed concurrently, and the number
+	// of goroutines enriching them. Records are assigned to enrichment
+	// goroutines by country, so each country's subdivision table and cache
+	// are only ever used by one of them.
+	Workers int
+
+	// Skipped counts the malformed records skipped so far.
+	Skipped int
+
+	// OnRecordSkipped, if set, is called with the reason whenever a record
+	// is dropped: skipped as malformed, dated in the future with DropFuture
+	// or older than MaxAge. Calls are serialized.
+	OnRecordSkipped func(reason string)
+
+	mu         sync.Mutex
+	mismatched map[string]bool
+}
+
+// errStop is returned by a decode callback to end decoding early.
+var errStop = errors.New("stop decoding")
+
+// parseDatapoints reads and enriches every record in r.
+func (p *parser) parseDatapoints(r io.Reader) ([]datapoint, error) {
+	var points []datapoint
+	err := p.decode(r, func(d datapoint) error {
+		points = append(points, d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// streamDatapoints reads and enriches the records in r in the background,
+// sending each on the returned channel as soon as it is ready. The channel is
+// closed when r is exhausted, decoding fails or ctx is done, so a consumer
+// that stops reading early must cancel ctx; the error channel then receives
+// the outcome, nil on success.
+func (p *parser) streamDatapoints(ctx context.Context, r io.Reader) (<-chan datapoint, <-chan error) {
+	out := make(chan datapoint)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(out)
+		errc <- p.decode(r, func(d datapoint) error {
+			select {
+			case out <- d:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return out, errc
+}
+
+// decode parses and enriches the records in r, calling fn for each of them.
+// With Workers > 1 records are parsed and enriched concurrently and fn sees
+// them in no particular order; fn itself is never called concurrently.
+// Decoding stops at the first error returned by fn.
+func (p *parser) decode(r io.Reader, fn func(datapoint) error) error {
+	if p.Workers <= 1 {
+		e := p.newEnricher()
+		return readRecords(r, func(i int, rec json.RawMessage) error {
+			d, ok, err := p.parse(i, rec)
+			if err == nil && ok {
+				err = e.enrichRecord(i, &d)
+			}
+			if err != nil || !ok {
+				return err
+			}
+			return fn(d)
+		})
+	}
+
+	type job struct {
+		i   int
+		rec json.RawMessage
+	}
+	type parsed struct {
+		i   int
+		d   datapoint
+		ok  bool
+		err error
+	}
+
+	jobs := make(chan job)
+	out := make(chan parsed)
+	done := make(chan struct{})
+
+	// Parsed records are handed to the enrichment goroutine owning their
+	// country.
+	shards := make([]chan parsed, p.Workers)
+	var enrichers sync.WaitGroup
+	for k := range shards {
+		shards[k] = make(chan parsed)
+		enrichers.Add(1)
+		go func(in <-chan parsed) {
+			defer enrichers.Done()
+			e := p.newEnricher()
+			for x := range in {
+				x.err = e.enrichRecord(x.i, &x.d)
+				out <- x
+			}
+		}(shards[k])
+	}
+
+	var parsers sync.WaitGroup
+	for w := 0; w < p.Workers; w++ {
+		parsers.Add(1)
+		go func() {
+			defer parsers.Done()
+			for j := range jobs {
+				d, ok, err := p.parse(j.i, j.rec)
+				if err != nil || !ok || p.NoEnrich {
+					out <- parsed{j.i, d, ok, err}
+					continue
+				}
+				shards[countryShard(d.CountryCode, len(shards))] <- parsed{j.i, d, ok, nil}
+			}
+		}()
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		readErr <- readRecords(r, func(i int, rec json.RawMessage) error {
+			select {
+			case jobs <- job{i, rec}:
+				return nil
+			case <-done:
+				return errStop
+			}
+		})
+	}()
+	go func() {
+		parsers.Wait()
+		for _, sh := range shards {
+			close(sh)
+		}
+		enrichers.Wait()
+		close(out)
+	}()
+
+	var firstErr error
+	for res := range out {
+		if firstErr != nil {
+			continue
+		}
+		if res.err == nil && res.ok {
+			res.err = fn(res.d)
+		}
+		if res.err != nil {
+			firstErr = res.err
+			close(done)
+		}
+	}
+
+	if err := <-readErr; err != nil && err != errStop && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// countryShard returns which of n enrichment goroutines handles country.
+func countryShard(country string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(country))
+	return int(h.Sum32() % uint32(n))
+}
+
+// readRecords calls fn with every raw record in r and its position, stopping
+// at the first error fn returns.
+func readRecords(r io.Reader, fn func(int, json.RawMessage) error) error {
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+
+	array, err := isArray(br)
+	if err != nil {
+		return err
+	}
+	if array {
+		if _, err := dec.Token(); err != nil {
+			return fmt.Errorf("%w: %v", ErrParse, err)
+		}
+	}
+
+	for i := 0; ; i++ {
+		if array && !dec.More() {
+			break
+		}
+		var rec json.RawMessage
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%w: record %d: %v", ErrParse, i, err)
+		}
+		if err := fn(i, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parse parses record i. ok is false if the record was malformed and
+// skipped. It is safe to call concurrently.
+func (p *parser) parse(i int, rec json.RawMessage) (d datapoint, ok bool, err error) {
+	fields := p.Fields
+	if fields == nil {
+		fields = defaultFields
+	}
+	if err := fields.unmarshal(rec, &d); err != nil {
+		if !p.SkipBad {
+			return d, false, fmt.Errorf("%w: record %d: %v", ErrParse, i, err)
+		}
+		p.mu.Lock()
+		p.Skipped++
+		skipped := p.Skipped
+		p.recordSkipped("malformed record")
+		p.mu.Unlock()
+		log.Printf("Skipping bad record %d: %v", i, err)
+		if p.MaxBad > 0 && skipped > p.MaxBad {
+			return d, false, fmt.Errorf("%w: more than %d bad records, giving up", ErrParse, p.MaxBad)
+		}
+		return d, false, nil
+	}
+
+	if p.NormalizeSpace {
+		normalizeSpace(&d)
+	}
+
+	if p.CheckFuture && d.Ts.After(time.Now().Add(p.FutureTolerance)) {
+		p.mu.Lock()
+		p.Future++
+		first := p.Future == 1
+		if p.DropFuture {
+			p.recordSkipped("dated in the future")
+		}
+		p.mu.Unlock()
+		if first {
+			log.Printf("Warning: record %d is dated in the future, %s", i, d.Ts.Format(time.RFC3339))
+		}
+		if p.DropFuture {
+			return d, false, nil
+		}
+	}
+	if p.MaxAge > 0 && d.Ts.Before(time.Now().Add(-p.MaxAge)) {
+		p.mu.Lock()
+		p.TooOld++
+		p.recordSkipped("older than -max-age")
+		p.mu.Unlock()
+		return d, false, nil
+	}
+	return d, true, nil
+}
+
+// recordSkipped calls OnRecordSkipped, if set. p.mu must be held.
+func (p *parser) recordSkipped(reason string) {
+	if p.OnRecordSkipped != nil {
+		p.OnRecordSkipped(reason)
+	}
+}
+
+// malformed returns the number of malformed records skipped so far. Unlike
+// those dated in the future or older than MaxAge, they count towards
+// -max-skip-rate.
+func (p *parser) malformed() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Skipped
+}
+
+// normalizeSpace trims the string fields of d and collapses the whitespace
+// inside them.
+func normalizeSpace(d *datapoint) {
+	for _, f := range []*string{
+		&d.CountryName, &d.CountryCode,
+		&d.Province, &d.ProvinceCode,
+		&d.City, &d.CityCode,
+		&d.Status,
+	} {
+		*f = strings.Join(strings.Fields(*f), " ")
+	}
+}
+
+// isArray reports whether the first non-space byte in br opens a JSON array.
+func isArray(br *bufio.Reader) (bool, error) {
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			br.ReadByte()
+		default:
+			return b[0] == '[', nil
+		}
+	}
+}
+
+// enricher fills in the fields derived from the source data. It keeps the
+// subdivision table and province code cache of every country it has seen and
+// must only be used by one goroutine at a time.
+type enricher struct {
+	p      *parser
+	tables map[string]*countryTable
+}
+
+// countryTable is the subdivision table of a country, with the province codes
+// resolved from it so far.
+type countryTable struct {
+	country gountries.Country
+	err     error
+	codes   map[string]string
+}
+
+func (p *parser) newEnricher() *enricher {
+	return &enricher{p: p, tables: make(map[string]*countryTable)}
+}
+
+// enrichRecord enriches record i unless enrichment is off.
+func (e *enricher) enrichRecord(i int, d *datapoint) error {
+	if e.p.NoEnrich {
+		return nil
+	}
+	if err := e.enrich(d); err != nil {
+		return fmt.Errorf("%w: record %d: %v", ErrEnrich, i, err)
+	}
+	return nil
+}
+
+// table returns the subdivision table of the country with the given alpha-2
+// code, looking it up on first use.
+func (e *enricher) table(code string) *countryTable {
+	t, ok := e.tables[code]
+	if !ok {
+		t = &countryTable{codes: make(map[string]string)}
+		t.country, t.err = countryQuery().FindCountryByAlpha(code)
+		e.tables[code] = t
+	}
+	return t
+}
+
+// enrich fills in the fields derived from the source data.
+func (e *enricher) enrich(d *datapoint) error {
+	p := e.p
+	overrides := p.Overrides
+	if overrides == nil {
+		overrides = defaultOverrides
+	}
+
+	if code, ok := overrides[d.Province]; ok {
+		d.ProvinceCode = code
+	} else if t := e.table(d.CountryCode); t.err != nil {
+		return fmt.Errorf("country %q: %v", d.CountryCode, t.err)
+	} else if code, ok := t.codes[d.Province]; ok {
+		d.ProvinceCode = code
+	} else {
+		sub, err := t.country.FindSubdivisionByName(d.Province)
+		if err == nil && sub.CountryAlpha2 != "" && sub.CountryAlpha2 != t.country.Alpha2 {
+			err = fmt.Errorf("subdivision %s of %q belongs to %s", sub.Code, d.Province, sub.CountryAlpha2)
+		}
+		switch {
+		case err == nil:
+			d.ProvinceCode = t.country.Alpha2 + "-" + sub.Code
+			if len(t.codes) < p.CacheSize {
+				t.codes[d.Province] = d.ProvinceCode
+			}
+		case p.Unresolved != nil:
+			p.mu.Lock()
+			p.Unresolved[d.Province]++
+			p.mu.Unlock()
+			d.ProvinceCode = ""
+		default:
+			return err
+		}
+	}
+
+	alpha2 := d.CountryCode
+	if t := e.table(d.CountryCode); t.err == nil {
+		alpha2 = t.country.Alpha2
+	}
+	if err := p.checkCountry(d, alpha2); err != nil {
+		return err
+	}
+
+	if p.Gazetteer != nil && d.City != "" && d.CityCode == "" {
+		if code, ok := p.Gazetteer.lookup(d.CountryCode, d.Province, d.City); ok {
+			d.CityCode = code
+		} else {
+			p.mu.Lock()
+			p.CityMisses++
+			p.mu.Unlock()
+		}
+	}
+
+	return nil
+}
+
+// checkCountry applies OnMismatch to d if its ProvinceCode belongs to another
+// country than its CountryCode, whose alpha-2 code is alpha2. Province codes
+// always start with the alpha-2 code, whichever form CountryCode takes.
+func (p *parser) checkCountry(d *datapoint, alpha2 string) error {
+	if d.ProvinceCode == "" || strings.HasPrefix(d.ProvinceCode, alpha2+"-") {
+		return nil
+	}
+
+	key := d.CountryCode + "/" + d.Province
+	p.mu.Lock()
+	p.Mismatches++
+	first := !p.mismatched[key]
+	if first {
+		if p.mismatched == nil {
+			p.mismatched = make(map[string]bool)
+		}
+		p.mismatched[key] = true
+	}
+	p.mu.Unlock()
+
+	switch p.OnMismatch {
+	case "keep":
+	case "fail":
+		return fmt.Errorf("province code %s of %q does not belong to country %s", d.ProvinceCode, d.Province, d.CountryCode)
+	default:
+		if first {
+			log.Printf("Warning: province code %s of %q does not belong to country %s, leaving it blank", d.ProvinceCode, d.Province, d.CountryCode)
+		}
+		d.ProvinceCode = ""
+		return nil
+	}
+	if first {
+		log.Printf("Warning: province code %s of %q does not belong to country %s", d.ProvinceCode, d.Province, d.CountryCode)
+	}
+	return nil
+}
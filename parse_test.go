@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// record returns a source record for a province of the United States.
+func record(province string, cases int) string {
+	return fmt.Sprintf(`{"Country":"United States of America","CountryCode":"US","Province":%q,"City":"","CityCode":"","Lat":"40.1","Lon":"-74.2","Cases":%d,"Status":"confirmed","Date":"2020-03-01T00:00:00Z"}`, province, cases)
+}
+
+// records returns n records as newline delimited JSON.
+func records(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteString(record("New York", i))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func TestParseDatapoints(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+	}{
+		{"array", "[" + record("New York", 1) + "," + record("Texas", 2) + "]"},
+		{"ndjson", record("New York", 1) + "\n" + record("Texas", 2) + "\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			points, err := (&parser{}).parseDatapoints(strings.NewReader(tc.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(points) != 2 {
+				t.Fatalf("got %d records, want 2", len(points))
+			}
+			if points[0].ProvinceCode != "US-NY" || points[1].ProvinceCode != "US-TX" {
+				t.Errorf("province codes %q, %q; want US-NY, US-TX", points[0].ProvinceCode, points[1].ProvinceCode)
+			}
+			if points[1].Cases != 2 {
+				t.Errorf("cases = %d, want 2", points[1].Cases)
+			}
+		})
+	}
+}
+
+func TestParserRecordSkipped(t *testing.T) {
+	dated := func(date string) string {
+		return strings.Replace(record("New York", 1), "2020-03-01T00:00:00Z", date, 1)
+	}
+	input := strings.Join([]string{
+		record("New York", 1),
+		`{"Cases":"many"}`,
+		dated("2099-01-01T00:00:00Z"),
+		dated("2019-01-01T00:00:00Z"),
+		record("Texas", 2),
+	}, "\n")
+
+	reasons := make(map[string]int)
+	p := &parser{
+		SkipBad:         true,
+		CheckFuture:     true,
+		DropFuture:      true,
+		MaxAge:          time.Since(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)),
+		OnRecordSkipped: func(reason string) { reasons[reason]++ },
+	}
+	points, err := p.parseDatapoints(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 {
+		t.Errorf("got %d records, want 2", len(points))
+	}
+	want := map[string]int{"malformed record": 1, "dated in the future": 1, "older than -max-age": 1}
+	if len(reasons) != len(want) {
+		t.Errorf("skip reasons = %v, want %v", reasons, want)
+	}
+	for r, n := range want {
+		if reasons[r] != n {
+			t.Errorf("%q: %d records, want %d", r, reasons[r], n)
+		}
+	}
+	if got := p.malformed(); got != 1 {
+		t.Errorf("%d malformed records, want 1", got)
+	}
+}
+
+func TestParserCodeMismatch(t *testing.T) {
+	// An override meant for the US Virgin Islands applied to the British
+	// ones.
+	gb := strings.NewReplacer(`"United States of America"`, `"United Kingdom"`, `"US"`, `"GB"`)
+	input := gb.Replace(record("Virgin Islands", 1)) + "\n" + gb.Replace(record("Virgin Islands", 2))
+	overrides := map[string]string{"Virgin Islands": "US-VI"}
+
+	for _, tc := range []struct {
+		onMismatch string
+		want       string
+		fails      bool
+	}{
+		{"", "", false},
+		{"blank", "", false},
+		{"keep", "US-VI", false},
+		{"fail", "", true},
+	} {
+		t.Run(fmt.Sprint("on-mismatch=", tc.onMismatch), func(t *testing.T) {
+			p := &parser{Overrides: overrides, OnMismatch: tc.onMismatch}
+			points, err := p.parseDatapoints(strings.NewReader(input))
+			if tc.fails {
+				if !errors.Is(err, ErrEnrich) {
+					t.Errorf("err = %v, want ErrEnrich", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(points) != 2 {
+				t.Fatalf("got %d records, want 2", len(points))
+			}
+			for _, d := range points {
+				if d.CountryCode != "GB" || d.ProvinceCode != tc.want {
+					t.Errorf("%s record got province code %q, want %q", d.CountryCode, d.ProvinceCode, tc.want)
+				}
+			}
+			if p.Mismatches != 2 {
+				t.Errorf("counted %d mismatches, want 2", p.Mismatches)
+			}
+		})
+	}
+}
+
+func TestParserAlpha3Country(t *testing.T) {
+	// Province codes start with the alpha-2 code, both when resolved and
+	// when overridden.
+	usa := strings.NewReplacer(`"US"`, `"USA"`)
+	input := usa.Replace(record("New York", 1)) + "\n" + usa.Replace(record("Virgin Islands", 2))
+	p := &parser{Overrides: map[string]string{"Virgin Islands": "US-VI"}}
+	points, err := p.parseDatapoints(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("got %d records, want 2", len(points))
+	}
+	if points[0].ProvinceCode != "US-NY" || points[1].ProvinceCode != "US-VI" {
+		t.Errorf("province codes %q, %q; want US-NY, US-VI", points[0].ProvinceCode, points[1].ProvinceCode)
+	}
+	if p.Mismatches != 0 {
+		t.Errorf("counted %d mismatches, want none", p.Mismatches)
+	}
+}
+
+func TestParserFutureRecords(t *testing.T) {
+	future := time.Now().AddDate(1, 0, 0).UTC().Format(time.RFC3339)
+	input := record("New York", 1) + "\n" +
+		strings.Replace(record("Texas", 2), "2020-03-01T00:00:00Z", future, 1)
+
+	for _, drop := range []bool{false, true} {
+		t.Run(fmt.Sprint("drop=", drop), func(t *testing.T) {
+			p := &parser{CheckFuture: true, DropFuture: drop, FutureTolerance: 24 * time.Hour}
+			points, err := p.parseDatapoints(strings.NewReader(input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Future != 1 {
+				t.Errorf("counted %d future records, want 1", p.Future)
+			}
+			want := 2
+			if drop {
+				want = 1
+			}
+			if len(points) != want {
+				t.Fatalf("got %d records, want %d", len(points), want)
+			}
+			if drop && points[0].Province != "New York" {
+				t.Errorf("kept %s, want the record dated in the past", points[0].Province)
+			}
+		})
+	}
+}
+
+func TestParserNormalizeSpace(t *testing.T) {
+	for _, province := range []string{
+		"New\u00a0York",
+		"New  York",
+		"  New York ",
+		"\tNew \u00a0 York\n",
+	} {
+		input := strings.Replace(record(province, 1), `"US"`, `" US "`, 1)
+		if _, err := (&parser{}).parseDatapoints(strings.NewReader(input)); err == nil {
+			t.Errorf("%q: resolved without normalizing", province)
+		}
+
+		p := &parser{NormalizeSpace: true}
+		points, err := p.parseDatapoints(strings.NewReader(input))
+		if err != nil {
+			t.Errorf("%q: %v", province, err)
+			continue
+		}
+		d := points[0]
+		if d.Province != "New York" || d.CountryCode != "US" || d.ProvinceCode != "US-NY" {
+			t.Errorf("%q: got %q, %q, %q; want New York, US, US-NY", province, d.Province, d.CountryCode, d.ProvinceCode)
+		}
+	}
+}
+
+func TestStreamDatapoints(t *testing.T) {
+	out, errc := (&parser{}).streamDatapoints(context.Background(), strings.NewReader(records(5)))
+	var n int
+	for range out {
+		n++
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("streamed %d records, want 5", n)
+	}
+}
+
+func TestStreamDatapointsCancel(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprint(workers, " workers"), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			p := &parser{Workers: workers}
+			out, errc := p.streamDatapoints(ctx, strings.NewReader(records(1000)))
+			<-out
+			cancel()
+
+			// The stream must end, rather than block on a consumer that
+			// stopped reading.
+			select {
+			case err := <-errc:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("err = %v, want context.Canceled", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("stream still running after cancellation")
+			}
+			for range out {
+			}
+		})
+	}
+}
+
+// benchProvinces are subdivisions of several countries that gountries
+// resolves by name.
+var benchProvinces = [][2]string{
+	{"US", "New York"}, {"US", "Texas"}, {"US", "California"}, {"US", "Florida"},
+	{"CA", "Ontario"}, {"CA", "Quebec"}, {"CA", "British Columbia"}, {"CA", "Alberta"},
+	{"AU", "New South Wales"}, {"AU", "Victoria"}, {"AU", "Queensland"},
+	{"IN", "Maharashtra"}, {"IN", "Kerala"}, {"IN", "Karnataka"},
+	{"DE", "Bayern"}, {"DE", "Berlin"}, {"DE", "Hessen"},
+}
+
+// provinceRecords returns n records as newline delimited JSON, cycling
+// through the first countries of benchProvinces' countries, or all of them
+// when countries is zero.
+func provinceRecords(n, countries int) string {
+	var pool [][2]string
+	seen := make(map[string]bool)
+	for _, cp := range benchProvinces {
+		if !seen[cp[0]] {
+			if countries > 0 && len(seen) == countries {
+				continue
+			}
+			seen[cp[0]] = true
+		}
+		pool = append(pool, cp)
+	}
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		cp := pool[i%len(pool)]
+		fmt.Fprintf(&b, `{"Country":"","CountryCode":%q,"Province":%q,"City":"","CityCode":"","Lat":"1","Lon":"1","Cases":%d,"Status":"confirmed","Date":"2020-03-01T00:00:00Z"}`+"\n", cp[0], cp[1], i)
+	}
+	return b.String()
+}
+
+// BenchmarkParseUploadWorkers runs records of five countries through the
+// pipeline of a streaming run, with province lookups uncached so enrichment
+// is CPU bound, against uploads that mostly wait on the cluster. Enrichment
+// is sharded by country, so mixed input is what lets parse workers help. The
+// two stages want very different numbers of workers, which a single shared
+// count, as in the 4/4 and 8/8 cases, cannot give them.
+func BenchmarkParseUploadWorkers(b *testing.B) {
+	defer func(size int) { *batchSize = size }(*batchSize)
+	*batchSize = 50
+
+	input := provinceRecords(2000, 0)
+	es := &fakeES{Latency: func(docs int) time.Duration { return 2 * time.Millisecond }}
+	for _, w := range [][2]int{{1, 1}, {4, 4}, {8, 8}, {1, 8}, {4, 8}} {
+		b.Run(fmt.Sprintf("parse=%d/upload=%d", w[0], w[1]), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				p := &parser{Workers: w[0]}
+				u := &Uploader{Client: es, Workers: w[1], Index: "covid"}
+				l := &loader{up: u, sink: u, summary: newSummary(), created: make(map[string]bool)}
+				if err := streamRecords(p, strings.NewReader(input), func(d datapoint) error {
+					return l.send(l.check([]datapoint{d}))
+				}); err != nil {
+					b.Fatal(err)
+				}
+				if err := l.wait(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkProvinceCache measures enrichment alone of records whose
+// provinces repeat, as they do in real feeds, with and without the province
+// cache.
+func BenchmarkProvinceCache(b *testing.B) {
+	points, err := (&parser{NoEnrich: true}).parseDatapoints(strings.NewReader(provinceRecords(2000, 0)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []int{0, 1000} {
+		b.Run(fmt.Sprint("cache=", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				e := (&parser{CacheSize: size}).newEnricher()
+				for j := range points {
+					d := points[j]
+					if err := e.enrichRecord(j, &d); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkEnrichWorkers parses and enriches records of five countries with
+// the province cache off, so lookups dominate, using one or several
+// enrichment goroutines. Records are sharded by country, so only inputs
+// mixing countries can spread the lookups over more than one goroutine.
+func BenchmarkEnrichWorkers(b *testing.B) {
+	input := provinceRecords(2000, 0)
+	for _, workers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprint("workers=", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				p := &parser{Workers: workers}
+				if err := p.decode(strings.NewReader(input), func(datapoint) error { return nil }); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rateLog logs messages keyed by what went wrong, printing each key at most
+// once per Interval. Repeats within the interval are counted and reported with
+// the next message for the key that gets through, or by flush, so a cluster
+// failing every batch yields a line per distinct error every few seconds
+// rather than one per document.
+type rateLog struct {
+	Interval time.Duration
+
+	mu   sync.Mutex
+	seen map[string]*rateEntry
+}
+
+type rateEntry struct {
+	last       time.Time
+	msg        string
+	suppressed int
+}
+
+func newRateLog(interval time.Duration) *rateLog {
+	return &rateLog{Interval: interval, seen: make(map[string]*rateEntry)}
+}
+
+// workerErrors rate limits the errors logged by the upload workers.
+var workerErrors = newRateLog(10 * time.Second)
+
+// Printf logs the message unless one with the same key was logged less than
+// Interval ago.
+func (l *rateLog) Printf(key, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.seen[key]
+	if !ok {
+		l.seen[key] = &rateEntry{last: now, msg: msg}
+		log.Print(msg)
+		return
+	}
+	if now.Sub(e.last) < l.Interval {
+		e.suppressed++
+		e.msg = msg
+		return
+	}
+	if e.suppressed > 0 {
+		msg = fmt.Sprintf("%s (x%d in last %s)", msg, e.suppressed+1, now.Sub(e.last).Round(time.Second))
+	}
+	e.last, e.msg, e.suppressed = now, msg, 0
+	log.Print(msg)
+}
+
+// flush reports the repeats still held back and forgets every key.
+func (l *rateLog) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var keys []string
+	for k, e := range l.seen {
+		if e.suppressed > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	now := time.Now()
+	for _, k := range keys {
+		e := l.seen[k]
+		log.Printf("%s (x%d in last %s)", e.msg, e.suppressed, now.Sub(e.last).Round(time.Second))
+	}
+	l.seen = make(map[string]*rateEntry)
+}
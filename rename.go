@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// renames maps the JSON names of datapoint fields to the names they are
+// indexed under. It implements flag.Value: each value is either from=to or a
+// JSON object of such pairs.
+type renames map[string]string
+
+func (r renames) String() string {
+	var pairs []string
+	for from, to := range r {
+		pairs = append(pairs, from+"="+to)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (r renames) Set(v string) error {
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "{") {
+		var m map[string]string
+		if err := json.Unmarshal([]byte(v), &m); err != nil {
+			return err
+		}
+		for from, to := range m {
+			r[from] = to
+		}
+		return nil
+	}
+	i := strings.Index(v, "=")
+	if i <= 0 || i == len(v)-1 {
+		return fmt.Errorf("expected from=to, got %q", v)
+	}
+	r[v[:i]] = v[i+1:]
+	return nil
+}
+
+// validate checks that every renamed field exists and that no two fields end
+// up with the same name.
+func (r renames) validate() error {
+	fields := jsonFieldNames()
+	known := make(map[string]bool)
+	for _, f := range fields {
+		known[f] = true
+	}
+
+	targets := make(map[string]string)
+	for _, f := range fields {
+		to := r.name(f)
+		if other, ok := targets[to]; ok {
+			return fmt.Errorf("fields %s and %s would both be indexed as %s", other, f, to)
+		}
+		targets[to] = f
+	}
+	for from := range r {
+		if !known[from] {
+			return fmt.Errorf("cannot rename unknown field %q", from)
+		}
+	}
+	return nil
+}
+
+// name returns the indexed name of field f.
+func (r renames) name(f string) string {
+	if to, ok := r[f]; ok {
+		return to
+	}
+	return f
+}
+
+// apply renames the keys of doc in place.
+func (r renames) apply(doc map[string]json.RawMessage) {
+	renamed := make(map[string]json.RawMessage, len(doc))
+	for k, v := range doc {
+		renamed[r.name(k)] = v
+	}
+	for k := range doc {
+		delete(doc, k)
+	}
+	for k, v := range renamed {
+		doc[k] = v
+	}
+}
+
+// marshal returns the JSON encoding of d with r applied.
+func (r renames) marshal(d datapoint) (json.RawMessage, error) {
+	b, err := json.Marshal(d)
+	if err != nil || len(r) == 0 {
+		return b, err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	r.apply(doc)
+	return json.Marshal(doc)
+}
+
+// jsonFieldNames returns the JSON names of the fields of datapoint.
+func jsonFieldNames() []string {
+	var names []string
+	t := reflect.TypeOf(datapoint{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dryRunSample prints one record as it looks after each stage of the
+// pipeline, then returns without contacting the cluster. sel picks the
+// record: either its position in the input, counting from 0 across every
+// input file, or field=value to take the first record whose parsed field has
+// that value.
+func dryRunSample(p *parser, sel string) {
+	index, field, value := -1, "", ""
+	if n, err := strconv.Atoi(sel); err == nil {
+		index = n
+	} else if i := strings.Index(sel, "="); i > 0 {
+		field, value = sel[:i], sel[i+1:]
+		if err := checkField(field); err != nil {
+			log.Fatal("-dry-run-sample: ", err)
+		}
+	} else {
+		log.Fatalf("-dry-run-sample: expected a record number or field=value, got %q", sel)
+	}
+
+	var raw json.RawMessage
+	found := false
+	n := 0
+	err := eachInput(func(r io.Reader) error {
+		return readRecords(r, func(_ int, rec json.RawMessage) error {
+			i := n
+			n++
+			if index >= 0 {
+				if i != index {
+					return nil
+				}
+			} else {
+				pd, ok, err := p.parse(i, rec)
+				if err != nil || !ok {
+					return err
+				}
+				if v, _ := fieldValue(pd, field); v != value {
+					return nil
+				}
+			}
+			raw, found = rec, true
+			return errStop
+		})
+	})
+	if err != nil && err != errStop {
+		log.Fatal("could not read file", err)
+	}
+	if !found {
+		log.Fatalf("-dry-run-sample: no record matches %q", sel)
+	}
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, raw, "", "  "); err != nil {
+		log.Fatal(err)
+	}
+	printStage("raw record", pretty.String())
+
+	d, ok, err := p.parse(n-1, raw)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !ok {
+		log.Fatal("-dry-run-sample: the record is malformed")
+	}
+	printStage("parsed", d)
+
+	if p.NoEnrich {
+		printStage("enriched", "(skipped, -no-enrich is set)")
+	} else {
+		provinces := &parser{Overrides: p.Overrides, Unresolved: p.Unresolved}
+		if err := provinces.newEnricher().enrich(&d); err != nil {
+			log.Fatal(err)
+		}
+		printStage("after province enrichment and overrides", d)
+		if p.Gazetteer != nil {
+			if err := p.newEnricher().enrich(&d); err != nil {
+				log.Fatal(err)
+			}
+			printStage("after city enrichment", d)
+		}
+	}
+
+	up := newUploader()
+	if hasIDs() {
+		d.ID = up.IDs.ID(d)
+		printStage("document ID", d.ID)
+	}
+
+	doc, err := up.document(d)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printStage("document source, after renames, run ID and timestamp mode", doc)
+
+	var body bytes.Buffer
+	if err := up.writeDoc(&body, json.NewEncoder(&body), d); err != nil {
+		log.Fatal(err)
+	}
+	printStage("bulk body", strings.TrimSuffix(body.String(), "\n"))
+}
+
+// printStage prints v under a heading naming the stage, as indented JSON
+// unless it is a string.
+func printStage(stage string, v interface{}) {
+	fmt.Printf("== %s ==\n", stage)
+	if s, ok := v.(string); ok {
+		fmt.Println(s)
+		return
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(b))
+}
+
+// eachInput calls fn with every input named by -input in turn.
+func eachInput(fn func(io.Reader) error) error {
+	if *input == "-" {
+		return fn(os.Stdin)
+	}
+	files, err := inputFiles(*input, time.Time{})
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = fn(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
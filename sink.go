@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Sink is a destination for batches of prepared records. Run consumes
+// batches from q until it is closed or ctx is done and sends the outcome of
+// each on the returned channel, which is closed once every batch is done.
+// *Uploader is the Elasticsearch sink.
+//
+// A sink takes the batch queue rather than a Write([]datapoint) error call
+// per batch, so that it runs its own workers and reports per batch counts the
+// way the bulk workers do: the batcher, -fail-fast and the summary then work
+// the same whatever the destination.
+type Sink interface {
+	Run(ctx context.Context, q <-chan batch) <-chan batchResult
+}
+
+// kafkaSink produces every record as a message of its own to Topic. Messages
+// are keyed by document ID, so with a stable -id-strategy a record always
+// lands on the same partition.
+type kafkaSink struct {
+	Writer   *kafka.Writer
+	Workers  int
+	LogEvery int
+
+	// Encode returns the message value of d.
+	Encode func(d datapoint) ([]byte, error)
+
+	// Hooks, if set, is told as each batch starts and completes and each
+	// record is skipped, so that its progress reporting and watchdog follow
+	// the messages produced as they would the documents indexed.
+	Hooks *Uploader
+}
+
+// newKafkaSink returns a sink producing the documents up would index.
+func newKafkaSink(up *Uploader, brokers []string, topic string) *kafkaSink {
+	return &kafkaSink{
+		Writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			BatchSize:    *batchSize,
+			BatchTimeout: 10 * time.Millisecond,
+			RequiredAcks: kafka.RequireAll,
+		},
+		Workers:  up.Workers,
+		LogEvery: up.LogEvery,
+		Hooks:    up,
+		Encode: func(d datapoint) ([]byte, error) {
+			doc, err := up.document(d)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(doc)
+		},
+	}
+}
+
+// Close closes the writer and its connections to the brokers once every
+// batch has been produced.
+func (k *kafkaSink) Close() error {
+	return k.Writer.Close()
+}
+
+func (k *kafkaSink) Run(ctx context.Context, q <-chan batch) <-chan batchResult {
+	results := make(chan batchResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < k.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range q {
+				if ctx.Err() != nil {
+					continue
+				}
+				if k.Hooks != nil {
+					k.Hooks.batchStart(b.ID, len(b.Payload))
+				}
+				r := k.write(ctx, b)
+				if k.Hooks != nil {
+					k.Hooks.batchComplete(r)
+				}
+				results <- r
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
+
+// write produces the records of b and reports how many made it.
+func (k *kafkaSink) write(ctx context.Context, b batch) batchResult {
+	result := batchResult{
+		ID:        b.ID,
+		Countries: make(map[string]int),
+		Indices:   make(map[string]int),
+		Files:     make(map[string]int),
+	}
+
+	msgs := make([]kafka.Message, 0, len(b.Payload))
+	points := make([]datapoint, 0, len(b.Payload))
+	for _, d := range b.Payload {
+		v, err := k.Encode(d)
+		if err != nil {
+			log.Printf("Could not marshal json: %v ... skipping", err)
+			result.Failed++
+			if k.Hooks != nil {
+				k.Hooks.recordSkipped(fmt.Sprintf("could not marshal json: %v", err))
+			}
+			continue
+		}
+		m := kafka.Message{Value: v}
+		if d.ID != "" {
+			m.Key = []byte(d.ID)
+		}
+		msgs = append(msgs, m)
+		points = append(points, d)
+		result.BytesSent += int64(len(v))
+	}
+	if logBatch(b.ID, k.LogEvery) {
+		log.Printf("Producing batch %d of %d records\n", b.ID, len(msgs))
+	}
+
+	start := time.Now()
+	err := k.Writer.WriteMessages(ctx, msgs...)
+	result.Took = time.Since(start)
+
+	var errs kafka.WriteErrors
+	switch e := err.(type) {
+	case nil:
+	case kafka.WriteErrors:
+		errs = e
+	default:
+		workerErrors.Printf("kafka: "+err.Error(), "Failure producing batch %d: %s", b.ID, err)
+		result.Failed += len(msgs)
+		result.Err = fmt.Errorf("%w: %v", ErrConnection, err)
+		return result
+	}
+
+	var first error
+	for i, d := range points {
+		if i < len(errs) && errs[i] != nil {
+			result.Failed++
+			if first == nil {
+				first = errs[i]
+			}
+			continue
+		}
+		result.Indexed++
+		result.Indices[k.Writer.Topic]++
+		result.Countries[d.CountryCode]++
+		if d.Source != "" {
+			result.Files[d.Source]++
+		}
+	}
+	if first != nil {
+		workerErrors.Printf("kafka: "+first.Error(), "Failure producing batch %d: %d of %d messages failed, first: %v",
+			b.ID, errs.Count(), len(msgs), first)
+		result.Err = fmt.Errorf("%w: batch %d: %d messages failed, first: %v", ErrConnection, b.ID, errs.Count(), first)
+	}
+	return result
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestKafkaSinkHooks(t *testing.T) {
+	var started, completed, skipped int
+	up := &Uploader{
+		OnBatchStart:    func(id, size int) { started++ },
+		OnBatchComplete: func(r batchResult) { completed++ },
+		OnRecordSkipped: func(reason string) { skipped++ },
+	}
+	// Every record fails to encode, so nothing reaches the writer.
+	k := newKafkaSink(up, []string{"localhost:9092"}, "covid")
+	k.Workers = 1
+	k.Encode = func(datapoint) ([]byte, error) { return nil, errors.New("unsupported value") }
+	defer k.Close()
+
+	q := make(chan batch, 2)
+	q <- batch{ID: 1, Payload: testPoints(3)}
+	q <- batch{ID: 2, Payload: testPoints(2)}
+	close(q)
+	var failed int
+	for r := range k.Run(context.Background(), q) {
+		failed += r.Failed
+	}
+
+	if started != 2 || completed != 2 || skipped != 5 || failed != 5 {
+		t.Errorf("%d batches started, %d completed, %d records skipped, %d failed; want 2, 2, 5 and 5",
+			started, completed, skipped, failed)
+	}
+	if up.completed != 2 || len(up.active) != 0 {
+		t.Errorf("uploader saw %d batches completed, %d active; want 2 and none", up.completed, len(up.active))
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// summary accumulates the results of every batch in a run.
+type summary struct {
+	Indexed, Failed int
+	Conflicts       int
+	Skipped         int
+	Sent, Received  int64
+	Countries       map[string]int
+	Indices         map[string]int
+	Files           map[string]int
+
+	// Remaining counts the records never sent, or abandoned in flight,
+	// because the run stopped early. They are neither indexed nor failed.
+	Remaining int
+}
+
+func newSummary() *summary {
+	return &summary{
+		Countries: make(map[string]int),
+		Indices:   make(map[string]int),
+		Files:     make(map[string]int),
+	}
+}
+
+// add merges r into s.
+func (s *summary) add(r batchResult) {
+	s.Indexed += r.Indexed
+	s.Failed += r.Failed
+	s.Conflicts += r.Conflicts
+	s.Sent += r.BytesSent
+	s.Received += r.BytesReceived
+	for c, n := range r.Countries {
+		s.Countries[c] += n
+	}
+	for idx, n := range r.Indices {
+		s.Indices[idx] += n
+	}
+	for f, n := range r.Files {
+		s.Files[f] += n
+	}
+}
+
+// print logs the totals, the top countries and, when more than one index was
+// written to or more than one file read, the per-index and per-file counts.
+func (s *summary) print() {
+	log.Println(strings.Repeat("-", 30))
+	log.Printf("Indexed %d records, %d failed", s.Indexed, s.Failed)
+	if s.Conflicts > 0 {
+		log.Printf("%d records conflicted with existing documents", s.Conflicts)
+	}
+	if s.Remaining > 0 {
+		log.Printf("%d records were not sent", s.Remaining)
+	}
+	log.Printf("Sent %s, received %s", formatBytes(s.Sent), formatBytes(s.Received))
+	for _, c := range topCountries(s.Countries, 10) {
+		log.Printf("  %-4s %d", c.Code, c.Count)
+	}
+	if len(s.Indices) > 1 {
+		var names []string
+		for idx := range s.Indices {
+			names = append(names, idx)
+		}
+		sort.Strings(names)
+		for _, idx := range names {
+			log.Printf("  %s: %d", idx, s.Indices[idx])
+		}
+	}
+	if len(s.Files) > 1 {
+		var names []string
+		for f := range s.Files {
+			names = append(names, f)
+		}
+		sort.Strings(names)
+		for _, f := range names {
+			log.Printf("  %s: %d", f, s.Files[f])
+		}
+	}
+}
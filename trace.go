@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tracer starts the spans recorded for a run: one for the run as a whole and
+// one per bulk request. The default discards them; with -otel-endpoint they
+// are sent to an OpenTelemetry collector as the run goes and when it ends.
+type tracer interface {
+	// start begins a span named name, as a child of the span in ctx if any,
+	// and returns a context carrying it.
+	start(ctx context.Context, name string) (context.Context, span)
+
+	// flush sends the spans ended so far.
+	flush() error
+}
+
+// span is a timed operation. Attribute values may be strings, ints or bools.
+type span interface {
+	setAttr(key string, v interface{})
+
+	// traceparent returns the W3C trace context header identifying the
+	// span, or "" if it isn't recorded.
+	traceparent() string
+
+	// end finishes the span, marking it failed if err is non-nil.
+	end(err error)
+}
+
+// tracing is the tracer in use.
+var tracing tracer = noopTracer{}
+
+type noopTracer struct{}
+
+func (noopTracer) start(ctx context.Context, name string) (context.Context, span) {
+	return ctx, noopSpan{}
+}
+
+func (noopTracer) flush() error { return nil }
+
+type noopSpan struct{}
+
+func (noopSpan) setAttr(string, interface{}) {}
+func (noopSpan) traceparent() string         { return "" }
+func (noopSpan) end(error)                   {}
+
+// otlpTracer buffers ended spans and posts them to an OTLP/HTTP collector as
+// JSON. That keeps the exporter to the standard library at the cost of
+// batching: the buffer is sent every interval, as soon as it holds
+// otlpMaxBuffered spans, and by flush. A run that is killed loses at most the
+// spans of its last interval.
+type otlpTracer struct {
+	URL    string
+	Client *http.Client
+
+	mu    sync.Mutex
+	spans []*otlpSpan
+
+	// sendMu serializes exports, so the flush at the end of a run waits for
+	// one still being sent in the background.
+	sendMu sync.Mutex
+	full   chan struct{}
+}
+
+// otlpExportInterval is how often the spans buffered are exported, and
+// otlpMaxBuffered how many may pile up before they are exported early.
+const (
+	otlpExportInterval = 5 * time.Second
+	otlpMaxBuffered    = 512
+)
+
+// newOTLPTracer returns a tracer exporting to endpoint, the base URL of a
+// collector such as http://localhost:4318 or the full URL of its traces
+// endpoint, every interval.
+func newOTLPTracer(endpoint string, interval time.Duration) *otlpTracer {
+	u := strings.TrimRight(endpoint, "/")
+	if !strings.HasSuffix(u, "/v1/traces") {
+		u += "/v1/traces"
+	}
+	t := &otlpTracer{
+		URL:    u,
+		Client: &http.Client{Timeout: 10 * time.Second},
+		full:   make(chan struct{}, 1),
+	}
+	go t.export(interval)
+	return t
+}
+
+// export flushes the buffered spans every interval, or once the buffer is
+// full, for the life of the process.
+func (t *otlpTracer) export(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-t.full:
+		}
+		if err := t.flush(); err != nil {
+			log.Printf("Warning: could not export traces: %v", err)
+		}
+	}
+}
+
+type spanKey struct{}
+
+func (t *otlpTracer) start(ctx context.Context, name string) (context.Context, span) {
+	s := &otlpSpan{t: t, Name: name, Start: time.Now(), Attrs: make(map[string]interface{})}
+	if parent, ok := ctx.Value(spanKey{}).(*otlpSpan); ok {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+	} else {
+		s.TraceID = randomHex(16)
+	}
+	s.SpanID = randomHex(8)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (t *otlpTracer) flush() error {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	var out []map[string]interface{}
+	for _, s := range spans {
+		out = append(out, s.otlp())
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttrs(map[string]interface{}{"service.name": "covid"}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/coreyvan/covid"},
+				"spans": out,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := t.Client.Post(t.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode > 299 {
+		return fmt.Errorf("could not export %d spans to %s: %s", len(spans), t.URL, res.Status)
+	}
+	return nil
+}
+
+type otlpSpan struct {
+	t *otlpTracer
+
+	TraceID, SpanID, ParentID string
+	Name                      string
+	Start, End                time.Time
+	Attrs                     map[string]interface{}
+	Err                       error
+
+	mu sync.Mutex
+}
+
+func (s *otlpSpan) setAttr(key string, v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attrs[key] = v
+}
+
+func (s *otlpSpan) traceparent() string {
+	return "00-" + s.TraceID + "-" + s.SpanID + "-01"
+}
+
+func (s *otlpSpan) end(err error) {
+	s.mu.Lock()
+	s.End, s.Err = time.Now(), err
+	s.mu.Unlock()
+
+	s.t.mu.Lock()
+	s.t.spans = append(s.t.spans, s)
+	full := len(s.t.spans) >= otlpMaxBuffered
+	s.t.mu.Unlock()
+	if full {
+		select {
+		case s.t.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// otlp returns s in the OTLP JSON encoding.
+func (s *otlpSpan) otlp() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := map[string]interface{}{
+		"traceId":           s.TraceID,
+		"spanId":            s.SpanID,
+		"name":              s.Name,
+		"kind":              1, // SPAN_KIND_INTERNAL
+		"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+		"attributes":        otlpAttrs(s.Attrs),
+		"status":            map[string]interface{}{"code": 1}, // STATUS_CODE_OK
+	}
+	if s.ParentID != "" {
+		m["parentSpanId"] = s.ParentID
+	}
+	if s.Err != nil {
+		m["status"] = map[string]interface{}{"code": 2, "message": s.Err.Error()} // STATUS_CODE_ERROR
+	}
+	return m
+}
+
+func otlpAttrs(attrs map[string]interface{}) []interface{} {
+	var out []interface{}
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch x := v.(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(x)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(x, 10)}
+		case bool:
+			value = map[string]interface{}{"boolValue": x}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(x)}
+		}
+		out = append(out, map[string]interface{}{"key": k, "value": value})
+	}
+	return out
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal("could not generate trace ID: ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// startTrace sets up tracing from the command line and starts the span of
+// the run. The returned function ends it and exports the spans; only its
+// first call has any effect.
+func startTrace() (context.Context, func(err error)) {
+	if *otelEndpoint != "" {
+		tracing = newOTLPTracer(*otelEndpoint, otlpExportInterval)
+	}
+	ctx, root := tracing.start(context.Background(), "covid.load")
+	root.setAttr("input", *input)
+	root.setAttr("index", *indexName)
+
+	var once sync.Once
+	return ctx, func(err error) {
+		once.Do(func() {
+			root.end(err)
+			if err := tracing.flush(); err != nil {
+				log.Printf("Warning: could not export traces: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is an OTLP/HTTP endpoint counting the spans posted to it.
+type collector struct {
+	mu    sync.Mutex
+	spans int
+	got   chan struct{}
+}
+
+func newCollector() (*collector, *httptest.Server) {
+	c := &collector{got: make(chan struct{}, 100)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []json.RawMessage `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				c.spans += len(ss.Spans)
+			}
+		}
+		c.mu.Unlock()
+		c.got <- struct{}{}
+	}))
+	return c, srv
+}
+
+func (c *collector) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.spans
+}
+
+func (c *collector) wait(t *testing.T) {
+	select {
+	case <-c.got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no spans exported")
+	}
+}
+
+func TestOTLPTracerExportsPeriodically(t *testing.T) {
+	c, srv := newCollector()
+	defer srv.Close()
+	tr := newOTLPTracer(srv.URL, 10*time.Millisecond)
+
+	ctx, root := tr.start(context.Background(), "covid.load")
+	_, sp := tr.start(ctx, "covid.bulk")
+	sp.end(nil)
+	c.wait(t)
+	if got := c.count(); got != 1 {
+		t.Errorf("exported %d spans before the run ended, want 1", got)
+	}
+
+	root.end(nil)
+	if err := tr.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.count(); got != 2 {
+		t.Errorf("exported %d spans, want 2", got)
+	}
+}
+
+func TestOTLPTracerExportsFullBuffer(t *testing.T) {
+	c, srv := newCollector()
+	defer srv.Close()
+	tr := newOTLPTracer(srv.URL, time.Hour)
+
+	ctx, _ := tr.start(context.Background(), "covid.load")
+	for i := 0; i < otlpMaxBuffered; i++ {
+		_, sp := tr.start(ctx, "covid.bulk")
+		sp.end(nil)
+	}
+	c.wait(t)
+	if got := c.count(); got != otlpMaxBuffered {
+		t.Errorf("exported %d spans, want %d", got, otlpMaxBuffered)
+	}
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+type batch struct {
+	Payload []datapoint
+	ID      int
+}
+
+// batchResult reports the outcome of a single bulk request back to main.
+// Countries and Indices hold the number of successfully indexed documents per
+// country code and per target index so that results from concurrent workers
+// can be merged without sharing any state.
+type batchResult struct {
+	ID        int
+	Indexed   int
+	Failed    int
+	Countries map[string]int
+	Indices   map[string]int
+
+	// Files counts the indexed documents by the input file they came from.
+	Files map[string]int
+
+	// BytesSent is the size of the NDJSON request body and BytesReceived the
+	// size of the response body read back from the cluster.
+	BytesSent     int64
+	BytesReceived int64
+
+	// Took is how long the bulk request took and Rejected the number of
+	// documents the cluster turned away with 429 Too Many Requests.
+	Took     time.Duration
+	Rejected int
+
+	// Conflicts is the number of documents refused with 409 Conflict because
+	// they already existed. Unless conflicts are ignored they are also
+	// counted in Failed.
+	Conflicts int
+
+	// Cancelled is the number of documents whose request was abandoned
+	// because ctx was cancelled. They count as neither indexed nor failed.
+	Cancelled int
+
+	// Err is set if any document in the batch failed. It wraps
+	// ErrConnection if the request failed outright and is a *BulkError if
+	// the cluster rejected the request or some of its documents.
+	Err error
+}
+
+type bulkResponse struct {
+	Errors bool                  `json:"errors"`
+	Items  []map[string]bulkItem `json:"items"`
+}
+
+type bulkItem struct {
+	Index  string `json:"_index"`
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// bulkDoer is the part of the Elasticsearch client the upload workers depend
+// on. *elasticsearch.Client satisfies it, and so can an in-memory fake that
+// simulates partial failures, rejections or timeouts without a cluster.
+type bulkDoer interface {
+	Perform(*http.Request) (*http.Response, error)
+}
+
+// Uploader fans batches out to a pool of bulk workers sharing one client.
+type Uploader struct {
+	Client  bulkDoer
+	Workers int
+
+	// NewClient, if set, is called once per worker to give it a dedicated
+	// client instead of sharing Client. Separate connection pools can help
+	// when one pool is the bottleneck at high worker counts, but they also
+	// multiply the number of open connections the cluster has to serve, so
+	// whether it pays off depends on the cluster.
+	NewClient func() (bulkDoer, error)
+
+	// Index is the target index. With IndexPerStatus set each document goes
+	// to an index derived from Index and its status instead.
+	Index          string
+	IndexPerStatus bool
+
+	// RoutingField names a datapoint field whose value is used as the routing
+	// key of each document, colocating e.g. all documents of one country on a
+	// single shard. Skewed data makes for skewed shards: with CountryCode the
+	// shard holding US documents will dwarf the rest.
+	RoutingField string
+
+	// Pipeline is the ingest pipeline every document is passed through.
+	Pipeline string
+
+	// OpType is the bulk action used for each document, "index" (the
+	// default) to overwrite existing documents or "create" to leave them be.
+	// With IgnoreConflicts set, documents refused by "create" because they
+	// already exist count as conflicts rather than failures, which makes
+	// re-running a load idempotent.
+	OpType          string
+	IgnoreConflicts bool
+
+	// VersionField names a datapoint field, a timestamp or an integer, used
+	// as the external version of each document. The cluster then refuses to
+	// replace a document with one of a lower version, so an older reload
+	// racing a newer one can't overwrite it; the refusals count as conflicts
+	// rather than failures. Timestamps are used in milliseconds.
+	VersionField string
+
+	// RunID, if set, is stamped onto every document so the documents of a
+	// run can be found, or deleted, together.
+	RunID string
+
+	// TimestampMode "ingest" sets the timestamp of each document to the time
+	// it is marshalled, keeping the source timestamp in event_date. The
+	// default, "source", leaves it as it is.
+	TimestampMode string
+
+	// IDs decides the ID of each document that doesn't have one yet. Nil
+	// leaves them to the cluster.
+	IDs IDGenerator
+
+	// Renames renames document fields as they are marshalled.
+	Renames renames
+
+	// Stream encodes each bulk request body into the request as it is sent,
+	// so no more than one document is held in memory at a time instead of the
+	// whole batch. The client must not retry requests, as retrying needs the
+	// body buffered anyway.
+	Stream bool
+
+	// LogEvery, if above 1, limits logging to every LogEvery-th batch.
+	LogEvery int
+
+	// BatchSize is the number of records per bulk request sent by Upload,
+	// and CancelGrace how long Upload lets requests in flight finish once
+	// its context is cancelled.
+	BatchSize   int
+	CancelGrace time.Duration
+
+	// MaxInflight caps the number of bulk requests in flight at once across
+	// all workers, independently of how many workers are building batches.
+	// Zero means no cap beyond the number of workers.
+	MaxInflight int
+
+	// Warmup staggers worker startup: worker i waits roughly i*Warmup, plus
+	// up to half a Warmup of jitter, before taking its first batch.
+	Warmup time.Duration
+
+	// OnBatchStart, OnBatchComplete and OnRecordSkipped, if set, are called as
+	// a batch is sent, as its result comes back and whenever a record is
+	// dropped instead of being sent. Workers fire them concurrently, but calls
+	// are serialized so the hooks themselves need no locking.
+	OnBatchStart    func(id, size int)
+	OnBatchComplete func(r batchResult)
+	OnRecordSkipped func(reason string)
+
+	hookMu   sync.Mutex
+	inflight chan struct{}
+
+	// stateMu guards the batches in flight and the count of those done, kept
+	// for the watchdog to report.
+	stateMu   sync.Mutex
+	active    map[int]batchState
+	completed int
+}
+
+// batchState is a batch being sent by a worker.
+type batchState struct {
+	Size  int
+	Start time.Time
+}
+
+// acquire waits for an in-flight request slot, or for ctx to be done, and
+// returns the function releasing it.
+func (u *Uploader) acquire(ctx context.Context) func() {
+	if u.inflight == nil {
+		return func() {}
+	}
+	select {
+	case u.inflight <- struct{}{}:
+		return func() { <-u.inflight }
+	case <-ctx.Done():
+		return func() {}
+	}
+}
+
+func (u *Uploader) batchStart(id, size int) {
+	u.stateMu.Lock()
+	if u.active == nil {
+		u.active = make(map[int]batchState)
+	}
+	u.active[id] = batchState{Size: size, Start: time.Now()}
+	u.stateMu.Unlock()
+
+	if u.OnBatchStart == nil {
+		return
+	}
+	u.hookMu.Lock()
+	defer u.hookMu.Unlock()
+	u.OnBatchStart(id, size)
+}
+
+func (u *Uploader) batchComplete(r batchResult) {
+	u.stateMu.Lock()
+	delete(u.active, r.ID)
+	u.completed++
+	u.stateMu.Unlock()
+
+	if u.OnBatchComplete == nil {
+		return
+	}
+	u.hookMu.Lock()
+	defer u.hookMu.Unlock()
+	u.OnBatchComplete(r)
+}
+
+func (u *Uploader) recordSkipped(reason string) {
+	if u.OnRecordSkipped == nil {
+		return
+	}
+	u.hookMu.Lock()
+	defer u.hookMu.Unlock()
+	u.OnRecordSkipped(reason)
+}
+
+// logBatches logs how many batches are done and how long each batch still in
+// flight has been running.
+func (u *Uploader) logBatches() {
+	u.stateMu.Lock()
+	defer u.stateMu.Unlock()
+	log.Printf("%d batches done, %d in flight", u.completed, len(u.active))
+	var ids []int
+	for id := range u.active {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		b := u.active[id]
+		log.Printf("  batch %d: %d records, running for %s", id, b.Size, time.Since(b.Start).Round(time.Millisecond))
+	}
+}
+
+// indexFor returns the index d should be written to.
+func (u *Uploader) indexFor(d datapoint) string {
+	if d.Index != "" {
+		return d.Index
+	}
+	if u.IndexPerStatus {
+		return statusIndex(u.Index, d.Status)
+	}
+	return u.Index
+}
+
+// bulkMeta is the metadata on the action line preceding each document.
+type bulkMeta struct {
+	Index   string `json:"_index"`
+	ID      string `json:"_id,omitempty"`
+	Routing string `json:"routing,omitempty"`
+
+	Version     *int64 `json:"version,omitempty"`
+	VersionType string `json:"version_type,omitempty"`
+}
+
+// bufPool holds the buffers bulk request bodies are built in.
+var bufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// writeDoc appends the action line and source of d to buf through enc, which
+// must write to buf. On error buf is left as it was.
+func (u *Uploader) writeDoc(buf *bytes.Buffer, enc *json.Encoder, d datapoint) error {
+	mark := buf.Len()
+	op := u.OpType
+	if op == "" {
+		op = "index"
+	}
+	if err := enc.Encode(map[string]bulkMeta{op: u.metaFor(d)}); err != nil {
+		buf.Truncate(mark)
+		return err
+	}
+	doc, err := u.document(d)
+	if err != nil {
+		buf.Truncate(mark)
+		return err
+	}
+	if err := enc.Encode(doc); err != nil {
+		buf.Truncate(mark)
+		return err
+	}
+	return nil
+}
+
+// document returns the source of the document indexed for d.
+func (u *Uploader) document(d datapoint) (interface{}, error) {
+	if u.RunID != "" {
+		d.RunID = u.RunID
+	}
+	if u.TimestampMode == "ingest" {
+		ts := d.Ts
+		d.EventDate = &ts
+		d.Ts = time.Now().UTC()
+	}
+	if len(u.Renames) > 0 {
+		return u.Renames.marshal(d)
+	}
+	return d, nil
+}
+
+// encodedBatch describes the documents of a batch written to a bulk request
+// body.
+type encodedBatch struct {
+	// Countries and Sources hold the country and source file of each
+	// document written, in order.
+	Countries, Sources []string
+
+	// Bytes is the size of the body and Failed the number of records that
+	// could not be marshalled and were left out.
+	Bytes  int64
+	Failed int
+}
+
+// encodeBatch writes the bulk request body for payload. With w nil the whole
+// body is left in buf; otherwise each document is moved on from buf to w as
+// soon as it is encoded, and the first error writing to w is returned.
+func (u *Uploader) encodeBatch(buf *bytes.Buffer, enc *json.Encoder, payload []datapoint, wid int, w io.Writer) (encodedBatch, error) {
+	eb := encodedBatch{
+		Countries: make([]string, 0, len(payload)),
+		Sources:   make([]string, 0, len(payload)),
+	}
+	for _, e := range payload {
+		mark := buf.Len()
+		if err := u.writeDoc(buf, enc, e); err != nil {
+			log.Printf("Worker %d: could not marshal json: %v ... skipping", wid, err)
+			eb.Failed++
+			u.recordSkipped(fmt.Sprintf("could not marshal json: %v", err))
+			continue
+		}
+		eb.Countries = append(eb.Countries, e.CountryCode)
+		eb.Sources = append(eb.Sources, e.Source)
+		eb.Bytes += int64(buf.Len() - mark)
+		if w != nil {
+			if _, err := buf.WriteTo(w); err != nil {
+				return eb, err
+			}
+		}
+	}
+	return eb, nil
+}
+
+// encodedSize returns the number of bytes d takes up in a bulk request body,
+// action line included.
+func (u *Uploader) encodedSize(d datapoint) int {
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer bufPool.Put(buf)
+	buf.Reset()
+	if err := u.writeDoc(buf, json.NewEncoder(buf), d); err != nil {
+		return 0
+	}
+	return buf.Len()
+}
+
+// metaFor returns the action metadata for d.
+func (u *Uploader) metaFor(d datapoint) bulkMeta {
+	m := bulkMeta{Index: u.indexFor(d), ID: d.ID}
+	if m.ID == "" && u.IDs != nil {
+		m.ID = u.IDs.ID(d)
+	}
+	if u.RoutingField != "" {
+		m.Routing, _ = fieldValue(d, u.RoutingField)
+	}
+	if u.VersionField != "" {
+		if v, ok := versionOf(d, u.VersionField); ok {
+			m.Version = &v
+			m.VersionType = "external"
+		}
+	}
+	return m
+}
+
+// Run starts the workers and returns a channel of their results. The channel
+// is closed once q has been closed and every batch on it has been processed.
+// Once ctx is done workers stop uploading and discard the batches still
+// queued, so that the producer is never left blocked.
+func (u *Uploader) Run(ctx context.Context, q <-chan batch) <-chan batchResult {
+	return u.run(ctx, ctx, q)
+}
+
+// run is Run with the requests sent on ctx, while stop decides when workers
+// stop taking batches. Once stop is done the batches still queued are
+// discarded, but the requests in flight only end early if ctx is done too.
+func (u *Uploader) run(stop, ctx context.Context, q <-chan batch) <-chan batchResult {
+	results := make(chan batchResult)
+	if u.MaxInflight > 0 {
+		u.inflight = make(chan struct{}, u.MaxInflight)
+	}
+
+	var wg sync.WaitGroup
+	if u.LogEvery > 1 {
+		log.Printf("Initializing %d workers", u.Workers)
+	}
+	for i := 0; i < u.Workers; i++ {
+		if u.LogEvery <= 1 {
+			log.Println("Initializing worker", i)
+		}
+		wg.Add(1)
+		go func(wid int) {
+			defer wg.Done()
+			if u.Warmup > 0 && wid > 0 {
+				jitter := time.Duration(rand.Int63n(int64(u.Warmup)/2 + 1))
+				time.Sleep(time.Duration(wid)*u.Warmup + jitter)
+			}
+			client := u.Client
+			if u.NewClient != nil {
+				c, err := u.NewClient()
+				if err != nil {
+					log.Printf("Worker %d: could not create client: %v ... using shared client", wid, err)
+				} else {
+					client = c
+				}
+			}
+			u.bulkUploader(stop, ctx, client, q, wid, results)
+		}(i)
+	}
+
+	go func() {
+		wg.Wait()
+		workerErrors.flush()
+		close(results)
+	}()
+
+	return results
+}
+
+func (u *Uploader) bulkUploader(stop, ctx context.Context, client bulkDoer, queue <-chan batch, wid int, results chan<- batchResult) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer bufPool.Put(buf)
+	enc := json.NewEncoder(buf)
+	rd := bytes.NewReader(nil)
+	var sp span = noopSpan{}
+	send := func(r batchResult) {
+		sp.setAttr("batch.indexed", r.Indexed)
+		sp.setAttr("batch.failed", r.Failed)
+		if r.Cancelled > 0 {
+			sp.setAttr("batch.cancelled", r.Cancelled)
+		}
+		if r.Err != nil {
+			sp.setAttr("batch.outcome", "error")
+		} else {
+			sp.setAttr("batch.outcome", "ok")
+		}
+		sp.end(r.Err)
+		sp = noopSpan{}
+		u.batchComplete(r)
+		results <- r
+	}
+
+	for batch := range queue {
+		if stop.Err() != nil || ctx.Err() != nil {
+			continue
+		}
+
+		result := batchResult{
+			ID:        batch.ID,
+			Countries: make(map[string]int),
+			Indices:   make(map[string]int),
+			Files:     make(map[string]int),
+		}
+
+		if logBatch(batch.ID, u.LogEvery) {
+			log.Printf("Uploading batch %d of %d records\n", batch.ID, len(batch.Payload))
+		}
+		u.batchStart(batch.ID, len(batch.Payload))
+
+		// eb holds the country and source of each document in the order it
+		// was written to the request, matching the order of the response
+		// items. When streaming it is only complete once wait returns.
+		var eb encodedBatch
+		var reqBody io.Reader
+		wait := func() {}
+		buf.Reset()
+		if u.Stream {
+			pr, pw := io.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				var err error
+				eb, err = u.encodeBatch(buf, enc, batch.Payload, wid, pw)
+				pw.CloseWithError(err)
+			}()
+			reqBody = pr
+			wait = func() {
+				pr.Close()
+				<-done
+				// Records not written, because they could not be marshalled
+				// or the request ended early, failed.
+				result.Failed += len(batch.Payload) - len(eb.Countries)
+				result.BytesSent = eb.Bytes
+				sp.setAttr("batch.bytes", result.BytesSent)
+			}
+		} else {
+			eb, _ = u.encodeBatch(buf, enc, batch.Payload, wid, nil)
+			result.Failed += eb.Failed
+			result.BytesSent = eb.Bytes
+			rd.Reset(buf.Bytes())
+			reqBody = rd
+		}
+		req := esapi.BulkRequest{
+			Index:    u.Index,
+			Body:     reqBody,
+			Pipeline: u.Pipeline,
+		}
+		_, sp = tracing.start(ctx, "covid.bulk")
+		sp.setAttr("batch.id", batch.ID)
+		sp.setAttr("batch.size", len(batch.Payload))
+		if !u.Stream {
+			sp.setAttr("batch.bytes", result.BytesSent)
+		}
+		if tp := sp.traceparent(); tp != "" {
+			req.Header = http.Header{"Traceparent": []string{tp}}
+		}
+		release := u.acquire(ctx)
+		start := time.Now()
+		res, err := req.Do(ctx, client)
+		result.Took = time.Since(start)
+		if err != nil && ctx.Err() != nil {
+			release()
+			wait()
+			// Only the records that could not be encoded failed; the rest
+			// were cut off rather than refused.
+			result.Cancelled = len(batch.Payload) - eb.Failed
+			result.Failed = eb.Failed
+			send(result)
+			continue
+		}
+		if err != nil {
+			release()
+			wait()
+			workerErrors.Printf("request: "+err.Error(), "Failure indexing batch %d: %s", batch.ID, err)
+			result.Failed += len(eb.Countries)
+			result.Err = fmt.Errorf("%w: %v", ErrConnection, err)
+			send(result)
+			continue
+		}
+
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		release()
+		wait()
+		result.BytesReceived = int64(len(body))
+		if err != nil && ctx.Err() != nil {
+			result.Cancelled = len(batch.Payload) - eb.Failed
+			result.Failed = eb.Failed
+			send(result)
+			continue
+		}
+		if err != nil {
+			workerErrors.Printf("read: "+err.Error(), "Failure reading response body: %s", err)
+			result.Failed += len(eb.Countries)
+			result.Err = fmt.Errorf("%w: %v", ErrConnection, err)
+			send(result)
+			continue
+		}
+
+		if res.IsError() {
+			result.Failed += len(eb.Countries)
+			if res.StatusCode == http.StatusTooManyRequests {
+				result.Rejected += len(eb.Countries)
+			}
+			be := &BulkError{BatchID: batch.ID, Status: res.StatusCode}
+			var er struct {
+				Error struct {
+					Type   string `json:"type"`
+					Reason string `json:"reason"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(body, &er); err != nil {
+				workerErrors.Printf("parse: "+err.Error(), "Failure to to parse response body: %s", err)
+				be.Reason = string(body)
+			} else {
+				be.Type, be.Reason = er.Error.Type, er.Error.Reason
+				// Reasons name the document or shard, so only the status and
+				// type make up the key; the latest reason is what gets logged.
+				workerErrors.Printf(fmt.Sprintf("request %d %s", res.StatusCode, be.Type),
+					"  Error: [%d] %s: %s", res.StatusCode, be.Type, be.Reason)
+			}
+			result.Err = be
+			send(result)
+			continue
+		}
+
+		var br bulkResponse
+		if err := json.Unmarshal(body, &br); err != nil {
+			workerErrors.Printf("parse: "+err.Error(), "Failure to to parse response body: %s", err)
+			result.Failed += len(eb.Countries)
+			result.Err = &BulkError{BatchID: batch.ID, Status: res.StatusCode, Reason: err.Error()}
+			send(result)
+			continue
+		}
+
+		var be *BulkError
+		for i, item := range br.Items {
+			for _, v := range item {
+				if v.Status == http.StatusConflict {
+					result.Conflicts++
+					if u.IgnoreConflicts || u.VersionField != "" {
+						continue
+					}
+				}
+				if v.Status > 299 {
+					if v.Status == http.StatusTooManyRequests {
+						result.Rejected++
+					}
+					workerErrors.Printf(fmt.Sprintf("item %d %s", v.Status, v.Error.Type),
+						"  Error: [%d] %s: %s", v.Status, v.Error.Type, v.Error.Reason)
+					result.Failed++
+					if be == nil {
+						be = &BulkError{BatchID: batch.ID, Status: res.StatusCode}
+					}
+					be.Items = append(be.Items, BulkItemError{
+						Index:  v.Index,
+						ID:     v.ID,
+						Status: v.Status,
+						Type:   v.Error.Type,
+						Reason: v.Error.Reason,
+					})
+					continue
+				}
+				result.Indexed++
+				result.Indices[v.Index]++
+				if i < len(eb.Countries) {
+					result.Countries[eb.Countries[i]]++
+					if eb.Sources[i] != "" {
+						result.Files[eb.Sources[i]]++
+					}
+				}
+			}
+		}
+		if be != nil {
+			result.Err = be
+		}
+		send(result)
+	}
+}
+
+// Stats describes how far an Upload got.
+type Stats struct {
+	Indexed int
+	Failed  int
+
+	// Skipped counts the documents deliberately not written, such as
+	// ignored conflicts.
+	Skipped int
+
+	// Remaining counts the records never sent because the upload was
+	// cancelled, and those of requests cut off when CancelGrace ran out.
+	Remaining int
+
+	Elapsed time.Duration
+}
+
+// defaultCancelGrace is the CancelGrace used when it is zero.
+const defaultCancelGrace = 5 * time.Second
+
+// Upload indexes points in batches of BatchSize and returns once every batch
+// is done or ctx is cancelled. On cancellation no further batches are sent,
+// the requests in flight get CancelGrace to finish, and Upload returns what
+// was achieved so far along with ctx.Err(). Requests still running after the
+// grace period are abandoned and their documents counted as Remaining.
+// Failed documents are reported in the Stats rather than as an error.
+func (u *Uploader) Upload(ctx context.Context, points []datapoint) (Stats, error) {
+	start := time.Now()
+
+	// Requests run on a context of their own so that cancelling ctx lets
+	// those in flight finish within the grace period, while no new ones
+	// start.
+	work, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-work.Done():
+			return
+		}
+		grace := u.CancelGrace
+		if grace <= 0 {
+			grace = defaultCancelGrace
+		}
+		t := time.NewTimer(grace)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			cancelWork()
+		case <-work.Done():
+		}
+	}()
+
+	size := u.BatchSize
+	if size <= 0 {
+		size = 50
+	}
+	in := make(chan datapoint)
+	go func() {
+		defer close(in)
+		for _, p := range points {
+			select {
+			case in <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	q := make(chan batch)
+	b := &batcher{Sizer: newBatchSizer(size, size, size, false), LogEvery: u.LogEvery}
+	go b.run(ctx, in, q)
+
+	var st Stats
+	for r := range u.run(ctx, work, q) {
+		st.Indexed += r.Indexed
+		st.Failed += r.Failed
+		if u.IgnoreConflicts || u.VersionField != "" {
+			st.Skipped += r.Conflicts
+		}
+	}
+	st.Remaining = len(points) - st.Indexed - st.Failed - st.Skipped
+	st.Elapsed = time.Since(start)
+	return st, ctx.Err()
+}
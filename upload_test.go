@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7"
+)
+
+// testPoints returns n datapoints spread over countries in turn, with Cases
+// counting up from 0.
+func testPoints(n int, countries ...string) []datapoint {
+	if len(countries) == 0 {
+		countries = []string{"US"}
+	}
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	points := make([]datapoint, n)
+	for i := range points {
+		points[i] = datapoint{
+			Ts:          start.Add(time.Duration(i) * time.Hour),
+			CountryName: countries[i%len(countries)],
+			CountryCode: countries[i%len(countries)],
+			Province:    fmt.Sprintf("Province %d", i),
+			Cases:       i,
+			Status:      "confirmed",
+		}
+	}
+	return points
+}
+
+// runBatches sends points through u in batches of size and returns every
+// result.
+func runBatches(ctx context.Context, u *Uploader, points []datapoint, size int) []batchResult {
+	q := make(chan batch)
+	results := u.Run(ctx, q)
+	go func() {
+		defer close(q)
+		for id := 1; len(points) > 0; id++ {
+			n := size
+			if n > len(points) {
+				n = len(points)
+			}
+			q <- batch{ID: id, Payload: points[:n]}
+			points = points[n:]
+		}
+	}()
+
+	var all []batchResult
+	for r := range results {
+		all = append(all, r)
+	}
+	return all
+}
+
+func sumResults(results []batchResult) *summary {
+	s := newSummary()
+	for _, r := range results {
+		s.add(r)
+	}
+	return s
+}
+
+func TestBulkUploaderPartialFailures(t *testing.T) {
+	es := &fakeES{ItemStatus: func(doc map[string]interface{}) int {
+		if int(doc["cases"].(float64))%10 == 3 {
+			return 400
+		}
+		return 201
+	}}
+	u := &Uploader{Client: es, Workers: 2, Index: "covid"}
+
+	results := runBatches(context.Background(), u, testPoints(100), 25)
+	s := sumResults(results)
+	if s.Indexed != 90 || s.Failed != 10 {
+		t.Errorf("indexed %d, failed %d; want 90 and 10", s.Indexed, s.Failed)
+	}
+	if got := len(es.Docs()); got != 90 {
+		t.Errorf("fake holds %d documents, want 90", got)
+	}
+	for _, r := range results {
+		var be *BulkError
+		if !errors.As(r.Err, &be) {
+			t.Fatalf("batch %d: err = %v, want a *BulkError", r.ID, r.Err)
+		}
+		if len(be.Items) != r.Failed || be.Items[0].Status != 400 {
+			t.Errorf("batch %d: %d item errors, first %+v; want %d with status 400", r.ID, len(be.Items), be.Items[0], r.Failed)
+		}
+	}
+}
+
+func TestBulkUploaderRejected(t *testing.T) {
+	es := &fakeES{Status: func(n int) int {
+		if n == 2 {
+			return http.StatusTooManyRequests
+		}
+		return 200
+	}}
+	u := &Uploader{Client: es, Workers: 1, Index: "covid"}
+
+	results := runBatches(context.Background(), u, testPoints(30), 10)
+	s := sumResults(results)
+	if s.Indexed != 20 || s.Failed != 10 {
+		t.Errorf("indexed %d, failed %d; want 20 and 10", s.Indexed, s.Failed)
+	}
+	var rejected int
+	for _, r := range results {
+		rejected += r.Rejected
+		if r.Rejected == 0 {
+			continue
+		}
+		var be *BulkError
+		if !errors.As(r.Err, &be) || be.Status != http.StatusTooManyRequests || be.Type != "es_rejected_execution_exception" {
+			t.Errorf("batch %d: err = %v, want a 429 *BulkError", r.ID, r.Err)
+		}
+	}
+	if rejected != 10 {
+		t.Errorf("rejected %d, want 10", rejected)
+	}
+}
+
+func TestBulkUploaderRejectionsShrinkAdaptiveBatches(t *testing.T) {
+	sizer := newBatchSizer(100, 10, 1000, true)
+	es := &fakeES{Status: func(int) int { return http.StatusTooManyRequests }}
+	u := &Uploader{Client: es, Workers: 1, Index: "covid"}
+
+	for _, r := range runBatches(context.Background(), u, testPoints(100), 100) {
+		sizer.Observe(r)
+	}
+	if got := sizer.Size(); got != 50 {
+		t.Errorf("size after a rejected batch = %d, want 50", got)
+	}
+}
+
+func TestBulkUploaderVersionConflicts(t *testing.T) {
+	// Every other document is older than the one already indexed.
+	es := &fakeES{ItemStatus: func(doc map[string]interface{}) int {
+		if int(doc["cases"].(float64))%2 == 1 {
+			return http.StatusConflict
+		}
+		return 201
+	}}
+
+	u := &Uploader{Client: es, Workers: 2, Index: "covid", IDs: compositeIDs{}, VersionField: "@timestamp"}
+	if m := u.metaFor(testPoints(1)[0]); m.ID == "" || m.Version == nil || m.VersionType != "external" {
+		t.Fatalf("action %+v, want an ID and an external version", m)
+	}
+	results := runBatches(context.Background(), u, testPoints(40), 10)
+	s := sumResults(results)
+	if s.Indexed != 20 || s.Failed != 0 || s.Conflicts != 20 {
+		t.Errorf("indexed %d, failed %d, conflicts %d; want 20, 0 and 20", s.Indexed, s.Failed, s.Conflicts)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Errorf("batch %d: err = %v, want none for stale versions", r.ID, r.Err)
+		}
+	}
+
+	// Without external versions a conflict is a failure.
+	u = &Uploader{Client: es, Workers: 2, Index: "covid", IDs: compositeIDs{}}
+	s = sumResults(runBatches(context.Background(), u, testPoints(40), 10))
+	if s.Indexed != 20 || s.Failed != 20 || s.Conflicts != 20 {
+		t.Errorf("without versions: indexed %d, failed %d, conflicts %d; want 20, 20 and 20", s.Indexed, s.Failed, s.Conflicts)
+	}
+}
+
+func TestBulkUploaderTimeout(t *testing.T) {
+	timeout := errors.New("net/http: request canceled (Client.Timeout exceeded while awaiting headers)")
+	es := &fakeES{Delay: 10 * time.Millisecond, Err: timeout}
+	u := &Uploader{Client: es, Workers: 2, Index: "covid"}
+
+	results := runBatches(context.Background(), u, testPoints(40), 10)
+	s := sumResults(results)
+	if s.Indexed != 0 || s.Failed != 40 {
+		t.Errorf("indexed %d, failed %d; want 0 and 40", s.Indexed, s.Failed)
+	}
+	for _, r := range results {
+		if !errors.Is(r.Err, ErrConnection) {
+			t.Errorf("batch %d: err = %v, want ErrConnection", r.ID, r.Err)
+		}
+	}
+}
+
+func TestBulkUploaderRateLimitsItemErrors(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer func() {
+		if testing.Verbose() {
+			log.SetOutput(os.Stderr)
+		} else {
+			log.SetOutput(ioutil.Discard)
+		}
+	}()
+
+	// Every document fails with the same type but a reason naming it.
+	es := &fakeES{ItemStatus: func(map[string]interface{}) int { return 400 }}
+	u := &Uploader{Client: es, Workers: 1, Index: "covid", IDs: compositeIDs{}, LogEvery: 100}
+	runBatches(context.Background(), u, testPoints(50), 10)
+
+	var lines int
+	for _, l := range strings.Split(out.String(), "\n") {
+		if strings.Contains(l, "mapper_parsing_exception") {
+			lines++
+		}
+	}
+	if lines != 2 {
+		t.Errorf("logged %d item errors, want the first and the repeats at flush:\n%s", lines, out.String())
+	}
+}
+
+func TestRunMergesCountriesAcrossWorkers(t *testing.T) {
+	es := &fakeES{ItemStatus: func(doc map[string]interface{}) int {
+		if doc["country_code"] == "CA" && int(doc["cases"].(float64))%2 == 0 {
+			return 400
+		}
+		return 201
+	}}
+	u := &Uploader{Client: es, Workers: 16, Index: "covid"}
+
+	// 1200 records, 400 per country; every other CA record fails.
+	s := sumResults(runBatches(context.Background(), u, testPoints(1200, "US", "CA", "GB"), 7))
+	want := map[string]int{"US": 400, "CA": 200, "GB": 400}
+	if len(s.Countries) != len(want) {
+		t.Errorf("countries = %v, want %v", s.Countries, want)
+	}
+	for c, n := range want {
+		if s.Countries[c] != n {
+			t.Errorf("%s: %d indexed, want %d", c, s.Countries[c], n)
+		}
+	}
+	if s.Indexed != 1000 || s.Failed != 200 {
+		t.Errorf("indexed %d, failed %d; want 1000 and 200", s.Indexed, s.Failed)
+	}
+
+	top := topCountries(s.Countries, 2)
+	if len(top) != 2 || top[0].Code != "GB" || top[1].Code != "US" {
+		t.Errorf("top countries = %v, want GB then US", top)
+	}
+}
+
+// BenchmarkClientsPerWorker compares workers sharing one client, and so one
+// connection pool, with workers holding a client each, over HTTP to a local
+// server. Whether separate pools pay off depends on the cluster and on how
+// many idle connections the transport keeps per host.
+func BenchmarkClientsPerWorker(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"errors":false,"items":[]}`)
+	}))
+	defer srv.Close()
+
+	newClient := func() (bulkDoer, error) {
+		return elasticsearch.NewClient(elasticsearch.Config{
+			Addresses: []string{srv.URL},
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+		})
+	}
+	shared, err := newClient()
+	if err != nil {
+		b.Fatal(err)
+	}
+	points := testPoints(2000)
+
+	for _, perWorker := range []bool{false, true} {
+		name := "shared"
+		if perWorker {
+			name = "per-worker"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				u := &Uploader{Client: shared, Workers: 32, Index: "covid"}
+				if perWorker {
+					u.NewClient = newClient
+				}
+				runBatches(context.Background(), u, points, 10)
+			}
+		})
+	}
+}
+
+// BenchmarkBulkBody compares building a bulk request body by marshalling
+// each document into a slice of its own, as the workers used to, with
+// encoding them all into a reused buffer.
+func BenchmarkBulkBody(b *testing.B) {
+	points := testPoints(1000)
+	u := &Uploader{Index: "covid"}
+
+	b.Run("marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var body []byte
+			for _, d := range points {
+				meta, err := json.Marshal(map[string]bulkMeta{"index": u.metaFor(d)})
+				if err != nil {
+					b.Fatal(err)
+				}
+				doc, err := json.Marshal(d)
+				if err != nil {
+					b.Fatal(err)
+				}
+				body = append(body, meta...)
+				body = append(body, '\n')
+				body = append(body, doc...)
+				body = append(body, '\n')
+			}
+			io.Copy(ioutil.Discard, bytes.NewReader(body))
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		rd := bytes.NewReader(nil)
+		for i := 0; i < b.N; i++ {
+			buf := bufPool.Get().(*bytes.Buffer)
+			buf.Reset()
+			if _, err := u.encodeBatch(buf, json.NewEncoder(buf), points, 0, nil); err != nil {
+				b.Fatal(err)
+			}
+			rd.Reset(buf.Bytes())
+			io.Copy(ioutil.Discard, rd)
+			bufPool.Put(buf)
+		}
+	})
+}
+
+func TestUploadCancel(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		delay   time.Duration
+		grace   time.Duration
+		indexed int
+	}{
+		// The batch in flight finishes within the grace period.
+		{"grace", 20 * time.Millisecond, 5 * time.Second, 10},
+		// The batch in flight is cut off.
+		{"cut-off", 5 * time.Second, 20 * time.Millisecond, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			started := make(chan struct{}, 10)
+			es := &fakeES{Delay: tc.delay, Started: started}
+			u := &Uploader{Client: es, Workers: 1, Index: "covid", BatchSize: 10, CancelGrace: tc.grace}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-started
+				cancel()
+			}()
+			st, err := u.Upload(ctx, testPoints(100))
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("err = %v, want context.Canceled", err)
+			}
+			if st.Indexed != tc.indexed || st.Failed != 0 || st.Remaining != 100-tc.indexed {
+				t.Errorf("indexed %d, failed %d, remaining %d; want %d, 0 and %d",
+					st.Indexed, st.Failed, st.Remaining, tc.indexed, 100-tc.indexed)
+			}
+			if n := es.Requests(); n != 1 {
+				t.Errorf("sent %d requests, want only the one in flight when cancelled", n)
+			}
+		})
+	}
+}
+
+// heapSampler is a bulkDoer that reads each request body in small chunks,
+// recording the largest heap in use seen while doing so.
+type heapSampler struct {
+	peak uint64
+}
+
+func (h *heapSampler) Perform(req *http.Request) (*http.Response, error) {
+	chunk := make([]byte, 64<<10)
+	var ms runtime.MemStats
+	for {
+		_, err := req.Body.Read(chunk)
+		runtime.ReadMemStats(&ms)
+		if ms.HeapInuse > h.peak {
+			h.peak = ms.HeapInuse
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	req.Body.Close()
+	return fakeResponse(200, bulkResponse{}), nil
+}
+
+// BenchmarkStreamBulk compares the peak heap of sending one large batch with
+// its body built in memory first and streamed as it is encoded.
+func BenchmarkStreamBulk(b *testing.B) {
+	points := testPoints(20000)
+	for _, stream := range []bool{false, true} {
+		name := "buffered"
+		if stream {
+			name = "streamed"
+		}
+		b.Run(name, func(b *testing.B) {
+			h := &heapSampler{}
+			runtime.GC()
+			for i := 0; i < b.N; i++ {
+				u := &Uploader{Client: h, Workers: 1, Index: "covid", Stream: stream}
+				runBatches(context.Background(), u, points, len(points))
+			}
+			b.ReportMetric(float64(h.peak)/(1<<20), "peak-heap-MiB")
+		})
+	}
+}
+
+func TestRunStopsTakingBatches(t *testing.T) {
+	es := &fakeES{}
+	u := &Uploader{Client: es, Workers: 2, Index: "covid"}
+	q := make(chan batch, 3)
+	for id := 1; id <= 3; id++ {
+		q <- batch{ID: id, Payload: testPoints(5)}
+	}
+	close(q)
+
+	// The caller has given up, though requests could still run.
+	stop, cancel := context.WithCancel(context.Background())
+	cancel()
+	for r := range u.run(stop, context.Background(), q) {
+		t.Errorf("batch %d sent after the upload was cancelled", r.ID)
+	}
+	if n := es.Requests(); n != 0 {
+		t.Errorf("sent %d requests, want none", n)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// validation counts the records found to be missing required fields.
+type validation struct {
+	Invalid int
+	Missing map[string]int
+}
+
+// validateRequired checks that every field in required is non-empty in each
+// of points. It returns the records that pass along with counts of those that
+// don't; drop controls whether failing records are left out of the result.
+func validateRequired(points []datapoint, required []string, drop bool) ([]datapoint, validation, error) {
+	v := validation{Missing: make(map[string]int)}
+	for _, f := range required {
+		if err := checkField(f); err != nil {
+			return nil, v, fmt.Errorf("-required: %v", err)
+		}
+	}
+	if len(required) == 0 {
+		return points, v, nil
+	}
+
+	valid := points[:0]
+	for _, p := range points {
+		ok := true
+		for _, f := range required {
+			if s, _ := fieldValue(p, f); strings.TrimSpace(s) == "" {
+				v.Missing[f]++
+				ok = false
+			}
+		}
+		if !ok {
+			v.Invalid++
+			if drop {
+				continue
+			}
+		}
+		valid = append(valid, p)
+	}
+	return valid, v, nil
+}
+
+// add adds the counts of o to v.
+func (v *validation) add(o validation) {
+	v.Invalid += o.Invalid
+	for f, n := range o.Missing {
+		if v.Missing == nil {
+			v.Missing = make(map[string]int)
+		}
+		v.Missing[f] += n
+	}
+}
+
+// report logs the number of invalid records and which fields they lacked.
+func (v validation) report() {
+	if v.Invalid == 0 {
+		return
+	}
+	log.Println("Records missing required fields:", v.Invalid)
+	var fields []string
+	for f := range v.Missing {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		log.Printf("  %s: %d", f, v.Missing[f])
+	}
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
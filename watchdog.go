@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// watchdog force-exits a run that is still going after a deadline, whether
+// or not whatever it is stuck on honors cancellation. Before exiting it logs
+// the state of the batches of the Uploader it watches and dumps the stacks
+// of every goroutine to stderr.
+type watchdog struct {
+	mu sync.Mutex
+	up *Uploader
+}
+
+// startWatchdog starts a watchdog firing after d. It never fires if d is not
+// positive.
+func startWatchdog(d time.Duration) *watchdog {
+	w := &watchdog{}
+	if d > 0 {
+		time.AfterFunc(d, func() { w.fire(d) })
+	}
+	return w
+}
+
+// watch makes up the Uploader whose batches are logged if w fires.
+func (w *watchdog) watch(up *Uploader) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.up = up
+}
+
+func (w *watchdog) fire(d time.Duration) {
+	log.Printf("Run still going after -max-runtime %s, aborting", d)
+	w.mu.Lock()
+	up := w.up
+	w.mu.Unlock()
+	if up != nil {
+		up.logBatches()
+	}
+
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	log.Printf("Goroutine stacks:\n%s", buf)
+	os.Exit(exitTimeout)
+}